@@ -1,10 +1,15 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/pfernandom/go-pypi/middleware"
+	"github.com/pfernandom/go-pypi/pipy"
 )
 
 var MAX_FILE_SIZE_MB int64 = 128
@@ -12,7 +17,58 @@ var MAX_FILE_SIZE_MB int64 = 128
 func main() {
 	config := &middleware.PyPiConfig{
 		MaxFileSizeMB: MAX_FILE_SIZE_MB,
+		IndexPath:     os.Getenv("INDEX_PATH"),
+		AdminToken:    os.Getenv("ADMIN_TOKEN"),
+		// immutable, allow-overwrite or allow-overwrite-dev-versions
+		OverwritePolicy: pipy.OverwritePolicy(os.Getenv("OVERWRITE_POLICY")),
+		// Comma separated, e.g. "acme-*,internal-tools"
+		ReservedProjects:     splitList(os.Getenv("RESERVED_PROJECTS")),
+		IsolateLocalProjects: os.Getenv("ISOLATE_LOCAL_PROJECTS") == "true",
+		MergedProjects:       splitList(os.Getenv("MERGED_PROJECTS")),
+		Offline:              os.Getenv("OFFLINE") == "true",
 	}
+	upstreams, err := upstreamsFromEnv()
+	if err != nil {
+		fmt.Println("Invalid upstream configuration:", err)
+		os.Exit(1)
+	}
+	config.Upstreams = upstreams
+	config.DescriptorCacheTTL, err = durationFromEnv("DESCRIPTOR_CACHE_TTL")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	config.DescriptorStaleWhileRevalidate, err = durationFromEnv("DESCRIPTOR_STALE_WHILE_REVALIDATE")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if bucket := os.Getenv("S3_BUCKET"); bucket != "" {
+		config.Storage = pipy.NewS3Storage(pipy.S3Config{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Region:          os.Getenv("S3_REGION"),
+			Bucket:          bucket,
+			Prefix:          os.Getenv("S3_PREFIX"),
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		})
+	}
+
+	// `go-pypi reindex` rebuilds the metadata database from the stored files
+	if len(os.Args) > 1 && os.Args[1] == "reindex" {
+		pipy.SetupStorage(config.Storage)
+		if err := pipy.SetupIndex(config.IndexPath); err != nil {
+			fmt.Println("Failed to open index:", err)
+			os.Exit(1)
+		}
+		if err := pipy.Reindex(); err != nil {
+			fmt.Println("Failed to rebuild index:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	mux := middleware.NewPyPiMux(config)
 	rootMux := http.NewServeMux()
 
@@ -23,3 +79,82 @@ func main() {
 	fmt.Println("Server listening on :4040")
 	http.ListenAndServe(":4040", rootMux)
 }
+
+// Upstream as written in UPSTREAMS_FILE
+type upstreamJson struct {
+	Name               string   `json:"name"`
+	URL                string   `json:"url"`
+	Projects           []string `json:"projects"`
+	Timeout            string   `json:"timeout"`
+	CAFile             string   `json:"ca_file"`
+	CertFile           string   `json:"cert_file"`
+	KeyFile            string   `json:"key_file"`
+	InsecureSkipVerify bool     `json:"insecure_skip_verify"`
+}
+
+// Reads the upstreams from the JSON list in UPSTREAMS_FILE, in priority order, or a single
+// upstream from the UPSTREAM_* variables
+func upstreamsFromEnv() ([]pipy.UpstreamConfig, error) {
+	configs := []upstreamJson{{
+		URL:                os.Getenv("UPSTREAM_URL"),
+		Timeout:            os.Getenv("UPSTREAM_TIMEOUT"),
+		CAFile:             os.Getenv("UPSTREAM_CA_FILE"),
+		CertFile:           os.Getenv("UPSTREAM_CERT_FILE"),
+		KeyFile:            os.Getenv("UPSTREAM_KEY_FILE"),
+		InsecureSkipVerify: os.Getenv("UPSTREAM_INSECURE_SKIP_VERIFY") == "true",
+	}}
+	if file := os.Getenv("UPSTREAMS_FILE"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &configs); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	upstreams := []pipy.UpstreamConfig{}
+	for _, config := range configs {
+		upstream := pipy.UpstreamConfig{
+			Name:               config.Name,
+			URL:                config.URL,
+			Projects:           config.Projects,
+			CAFile:             config.CAFile,
+			CertFile:           config.CertFile,
+			KeyFile:            config.KeyFile,
+			InsecureSkipVerify: config.InsecureSkipVerify,
+		}
+		if config.Timeout != "" {
+			timeout, err := time.ParseDuration(config.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timeout of upstream %s: %v", config.URL, err)
+			}
+			upstream.Timeout = timeout
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	return upstreams, nil
+}
+
+// Splits a comma separated list, ignoring blank items
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Parses a duration such as "10m" from an environment variable, nil if unset
+func durationFromEnv(name string) (*time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return &duration, nil
+}
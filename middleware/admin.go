@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	"github.com/pfernandom/go-pypi/pipy"
+)
+
+type yankRequest struct {
+	Reason string `json:"reason"`
+}
+
+// Requires the admin token. Without one configured the admin endpoints are disabled.
+func adminAuth(config *PyPiConfig) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if config.AdminToken == "" {
+				http.Error(w, "The admin API is disabled, it requires an admin token", http.StatusForbidden)
+				return
+			}
+			authorization := []byte(r.Header.Get("Authorization"))
+			if subtle.ConstantTimeCompare(authorization, []byte("Bearer "+config.AdminToken)) != 1 {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Yanks a release or a single file on POST, with an optional {"reason": "..."} body,
+// and un-yanks it on DELETE
+func handleYank(w http.ResponseWriter, r *http.Request) {
+	repo, version, filename := r.PathValue("package"), r.PathValue("version"), r.PathValue("filename")
+	yanked := r.Method == http.MethodPost
+	var request yankRequest
+	if yanked && r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid yank request body", http.StatusBadRequest)
+			return
+		}
+	}
+	err := pipy.SetYanked(repo, version, filename, yanked, request.Reason)
+	if err == pipy.RepoNotFound || err == pipy.FileNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to update yanked state", "error", err)
+		writeError(w, "Failed to update yanked state", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
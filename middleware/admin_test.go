@@ -0,0 +1,132 @@
+package middleware
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pfernandom/go-pypi/pipy"
+	"github.com/stretchr/testify/assert"
+)
+
+func getDescriptor(t *testing.T, server *httptest.Server, project string) *pipy.Response {
+	resp, err := http.Get(server.URL + "/simple/" + project + "/")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	var descriptor pipy.Response
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&descriptor))
+	return &descriptor
+}
+
+func yankedFiles(descriptor *pipy.Response) map[string]any {
+	yanked := map[string]any{}
+	for _, file := range descriptor.Files {
+		if file.Yanked != nil {
+			yanked[file.Filename] = *file.Yanked
+		}
+	}
+	return yanked
+}
+
+func newAdminRequest(method string, url string, body io.Reader) *http.Request {
+	req, _ := http.NewRequest(method, url, body)
+	req.Header.Set("Authorization", "Bearer secret")
+	return req
+}
+
+func TestYankRelease(t *testing.T) {
+	server, _ := newUploadServerWithConfig(t, &PyPiConfig{AdminToken: "secret"})
+	for _, filename := range []string{"my_package-1.0.tar.gz", "my_package-1.0.zip"} {
+		status, body := doRequest(t, newUploadRequest(t, server.URL+"/legacy/", twineFields("my-package", "1.0"), filename, newDistribution(t, filename, "")))
+		assert.Equal(t, http.StatusOK, status, body)
+	}
+
+	req := newAdminRequest("POST", server.URL+"/admin/my-package/1.0/yank", strings.NewReader(`{"reason": "broken build"}`))
+	status, _ := doRequest(t, req)
+	assert.Equal(t, http.StatusNoContent, status)
+	assert.Equal(t, map[string]any{
+		"my_package-1.0.tar.gz": "broken build",
+		"my_package-1.0.zip":    "broken build",
+	}, yankedFiles(getDescriptor(t, server, "my-package")))
+
+	req, _ = http.NewRequest("GET", server.URL+"/simple/my-package/", nil)
+	req.Header.Set("Accept", "text/html")
+	_, body := doRequest(t, req)
+	assert.Contains(t, body, `data-yanked="broken build">my_package-1.0.zip</a>`)
+
+	req = newAdminRequest("DELETE", server.URL+"/admin/my-package/1.0/yank", nil)
+	status, _ = doRequest(t, req)
+	assert.Equal(t, http.StatusNoContent, status)
+	assert.Empty(t, yankedFiles(getDescriptor(t, server, "my-package")))
+
+	req = newAdminRequest("POST", server.URL+"/admin/my-package/1.0/my_package-1.0.zip/yank", nil)
+	status, _ = doRequest(t, req)
+	assert.Equal(t, http.StatusNoContent, status)
+	assert.Equal(t, map[string]any{"my_package-1.0.zip": true}, yankedFiles(getDescriptor(t, server, "my-package")))
+
+	// The yanked state survives a rebuild of the index
+	assert.NoError(t, pipy.Reindex())
+	assert.Equal(t, map[string]any{"my_package-1.0.zip": true}, yankedFiles(getDescriptor(t, server, "my-package")))
+
+	for _, path := range []string{"/admin/other/1.0/yank", "/admin/my-package/2.0/yank", "/admin/my-package/1.0/other.zip/yank"} {
+		req = newAdminRequest("POST", server.URL+path, nil)
+		status, _ = doRequest(t, req)
+		assert.Equal(t, http.StatusNotFound, status, path)
+	}
+}
+
+func TestYankRequiresAdminToken(t *testing.T) {
+	server := httptest.NewServer(NewPyPiMux(&PyPiConfig{
+		MaxFileSizeMB: 128,
+		Storage:       pipy.NewFileSystemStorage(t.TempDir()),
+		IndexPath:     filepath.Join(t.TempDir(), "index.db"),
+		AdminToken:    "secret",
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("POST", server.URL+"/admin/my-package/1.0/yank", nil)
+	status, _ := doRequest(t, req)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	req, _ = http.NewRequest("POST", server.URL+"/admin/my-package/1.0/yank", nil)
+	req.Header.Set("Authorization", "Bearer secre")
+	status, _ = doRequest(t, req)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	status, _ = doRequest(t, newAdminRequest("POST", server.URL+"/admin/my-package/1.0/yank", nil))
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestAdminIsDisabledWithoutToken(t *testing.T) {
+	server, _ := newUploadServer(t)
+	status, body := doRequest(t, newUploadRequest(t, server.URL+"/legacy/", twineFields("my-package", "1.0"), "my_package-1.0.tar.gz", newDistribution(t, "my_package-1.0.tar.gz", "")))
+	assert.Equal(t, http.StatusOK, status, body)
+
+	for _, method := range []string{"POST", "DELETE"} {
+		req, _ := http.NewRequest(method, server.URL+"/admin/my-package/1.0/yank", nil)
+		status, _ := doRequest(t, req)
+		assert.Equal(t, http.StatusForbidden, status)
+	}
+	assert.Empty(t, yankedFiles(getDescriptor(t, server, "my-package")))
+}
+
+func TestOverwritingKeepsYank(t *testing.T) {
+	server, _ := newUploadServerWithConfig(t, &PyPiConfig{AdminToken: "secret", OverwritePolicy: pipy.OverwriteAllow})
+	filename := "my_package-1.0.tar.gz"
+	upload := func(content string) {
+		status, body := doRequest(t, newUploadRequest(t, server.URL+"/legacy/", twineFields("my-package", "1.0"), filename, newDistribution(t, filename, content)))
+		assert.Equal(t, http.StatusOK, status, body)
+	}
+	upload("first")
+	status, _ := doRequest(t, newAdminRequest("POST", server.URL+"/admin/my-package/1.0/"+filename+"/yank", strings.NewReader(`{"reason": "broken build"}`)))
+	assert.Equal(t, http.StatusNoContent, status)
+
+	upload("second")
+	descriptor := getDescriptor(t, server, "my-package")
+	assert.Equal(t, map[string]any{filename: "broken build"}, yankedFiles(descriptor))
+	assert.Equal(t, pipy.CalculateSHA256(newDistribution(t, filename, "second")), descriptor.Files[0].Hashes.SHA256)
+}
@@ -1,6 +1,8 @@
 package middleware
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 
 	"github.com/pfernandom/go-pypi/pipy"
@@ -19,3 +21,14 @@ func ErrorHandler(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// Writes the error, using the status code of client errors and upstream failures raised by
+// pipy
+func writeError(w http.ResponseWriter, message string, err error) {
+	var pipyErr *pipy.Error
+	if errors.As(err, &pipyErr) && (pipyErr.Code >= 400 && pipyErr.Code < 500 || pipyErr.Code >= 502 && pipyErr.Code <= 504) {
+		http.Error(w, pipyErr.Message, pipyErr.Code)
+		return
+	}
+	http.Error(w, fmt.Sprintf("%s: %v", message, err), http.StatusInternalServerError)
+}
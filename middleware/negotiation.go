@@ -0,0 +1,143 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pfernandom/go-pypi/pipy"
+)
+
+const (
+	contentTypeJSON       = "application/vnd.pypi.simple.v1+json"
+	contentTypeHTML       = "application/vnd.pypi.simple.v1+html"
+	contentTypeLegacyHTML = "text/html"
+)
+
+// Set on simple pages that couldn't be checked with the upstreams, so they may be out of date
+const staleHeader = "X-Upstream-Stale"
+
+// Content types we can serve, in order of preference (PEP 691)
+var supportedContentTypes = []string{contentTypeJSON, contentTypeHTML, contentTypeLegacyHTML}
+
+var contentTypeAliases = map[string]string{
+	"application/vnd.pypi.simple.latest+json": contentTypeJSON,
+	"application/vnd.pypi.simple.latest+html": contentTypeHTML,
+}
+
+type acceptedType struct {
+	mediaType string
+	quality   float64
+}
+
+func parseAccept(accept string) []acceptedType {
+	accepted := []acceptedType{}
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		if mediaType == "" {
+			continue
+		}
+		if alias, ok := contentTypeAliases[mediaType]; ok {
+			mediaType = alias
+		}
+		quality := 1.0
+		for _, param := range params[1:] {
+			name, value, found := strings.Cut(strings.TrimSpace(param), "=")
+			if !found || strings.ToLower(strings.TrimSpace(name)) != "q" {
+				continue
+			}
+			q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || q < 0 || q > 1 {
+				q = 0
+			}
+			quality = q
+		}
+		accepted = append(accepted, acceptedType{mediaType: mediaType, quality: quality})
+	}
+	return accepted
+}
+
+// Matches the media type against the accepted type, returning how specific the match is
+func matchMediaType(accepted string, mediaType string) (int, bool) {
+	if accepted == mediaType {
+		return 2, true
+	}
+	if accepted == "*/*" {
+		return 0, true
+	}
+	acceptedMain, acceptedSub, _ := strings.Cut(accepted, "/")
+	main, _, _ := strings.Cut(mediaType, "/")
+	if acceptedSub == "*" && acceptedMain == main {
+		return 1, true
+	}
+	return 0, false
+}
+
+// Picks the content type to respond with from the Accept header, or "" if none is acceptable
+func negotiateContentType(accept string) string {
+	if strings.TrimSpace(accept) == "" {
+		return supportedContentTypes[0]
+	}
+	accepted := parseAccept(accept)
+	best := ""
+	bestQuality := 0.0
+	for _, contentType := range supportedContentTypes {
+		// The most specific matching range decides the quality of a content type
+		quality, specificity := 0.0, -1
+		for _, a := range accepted {
+			if s, ok := matchMediaType(a.mediaType, contentType); ok && s > specificity {
+				quality, specificity = a.quality, s
+			}
+		}
+		if quality > bestQuality {
+			best, bestQuality = contentType, quality
+		}
+	}
+	return best
+}
+
+// Negotiates the response format, replying with 406 when nothing acceptable is available
+func negotiate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	w.Header().Add("Vary", "Accept")
+	contentType := negotiateContentType(r.Header.Get("Accept"))
+	if contentType == "" {
+		http.Error(w, "Not Acceptable, available content types: "+strings.Join(supportedContentTypes, ", "), http.StatusNotAcceptable)
+		return "", false
+	}
+	return contentType, true
+}
+
+func writeIndex(w http.ResponseWriter, r *http.Request, response *pipy.IndexResponse) {
+	contentType, ok := negotiate(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	if contentType == contentTypeJSON {
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if err := pipy.WriteIndexHTML(w, response); err != nil {
+		logger.Error("Failed to write index HTML", "error", err)
+	}
+}
+
+func writeDescriptor(w http.ResponseWriter, r *http.Request, response *pipy.Response) {
+	contentType, ok := negotiate(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	if response.Stale {
+		w.Header().Set(staleHeader, "true")
+	}
+	if contentType == contentTypeJSON {
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if err := pipy.WriteDescriptorHTML(w, response); err != nil {
+		logger.Error("Failed to write descriptor HTML", "error", err)
+	}
+}
@@ -0,0 +1,103 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pfernandom/go-pypi/pipy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateContentType(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{accept: "", want: contentTypeJSON},
+		{accept: "*/*", want: contentTypeJSON},
+		{accept: "text/html", want: contentTypeLegacyHTML},
+		{accept: "application/vnd.pypi.simple.v1+html", want: contentTypeHTML},
+		{accept: "application/vnd.pypi.simple.latest+json", want: contentTypeJSON},
+		{
+			// pip's default Accept header
+			accept: "application/vnd.pypi.simple.v1+json, application/vnd.pypi.simple.v1+html; q=0.1, text/html; q=0.01",
+			want:   contentTypeJSON,
+		},
+		{accept: "application/vnd.pypi.simple.v1+json; q=0.2, text/html", want: contentTypeLegacyHTML},
+		{accept: "text/*;q=0.5, application/vnd.pypi.simple.v1+html;q=0.4", want: contentTypeLegacyHTML},
+		{accept: "*/*;q=0.1, application/vnd.pypi.simple.v1+json;q=0", want: contentTypeHTML},
+		{accept: "application/json", want: ""},
+		{accept: "text/html;q=0", want: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.accept, func(t *testing.T) {
+			assert.Equal(t, test.want, negotiateContentType(test.accept))
+		})
+	}
+}
+
+func TestSimpleIndexContentNegotiation(t *testing.T) {
+	storage := pipy.NewFileSystemStorage(t.TempDir())
+	assert.NoError(t, storage.Put("my-package/1.0/my_package-1.0.tar.gz", strings.NewReader("sdist")))
+	mux := NewPyPiMux(&PyPiConfig{
+		MaxFileSizeMB: 128,
+		Storage:       storage,
+		IndexPath:     filepath.Join(t.TempDir(), "index.db"),
+	})
+	assert.NoError(t, pipy.Reindex())
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	get := func(path string, accept string) (*http.Response, string) {
+		req, err := http.NewRequest("GET", server.URL+path, nil)
+		assert.NoError(t, err)
+		req.Header.Set("Accept", accept)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp, string(body)
+	}
+
+	resp, body := get("/simple/", "text/html")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/html", resp.Header.Get("Content-Type"))
+	assert.Contains(t, body, `<a href="my-package/">my-package</a>`)
+
+	resp, body = get("/simple/my-package/", "application/vnd.pypi.simple.v1+html")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, contentTypeHTML, resp.Header.Get("Content-Type"))
+	assert.Contains(t, body, "#sha256="+pipy.CalculateSHA256([]byte("sdist"))+`">my_package-1.0.tar.gz</a>`)
+
+	resp, body = get("/simple/my-package/", "application/vnd.pypi.simple.v1+json")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, contentTypeJSON, resp.Header.Get("Content-Type"))
+	assert.Contains(t, body, `"filename":"my_package-1.0.tar.gz"`)
+
+	resp, _ = get("/simple/my-package/", "application/xml")
+	assert.Equal(t, http.StatusNotAcceptable, resp.StatusCode)
+	assert.Equal(t, "Accept", resp.Header.Get("Vary"))
+}
+
+func TestWriteDescriptorHTMLAttributes(t *testing.T) {
+	requiresPython := ">=3.8"
+	var yanked any = "broken build"
+	recorder := httptest.NewRecorder()
+	assert.NoError(t, pipy.WriteDescriptorHTML(recorder, &pipy.Response{
+		Name: "my-package",
+		Files: []pipy.File{{
+			Filename:       "my_package-1.0.tar.gz",
+			URL:            "1.0/my_package-1.0.tar.gz",
+			Hashes:         pipy.FileHashes{SHA256: "abc"},
+			RequiresPython: &requiresPython,
+			Yanked:         &yanked,
+		}},
+	}))
+	assert.Contains(t, recorder.Body.String(),
+		`<a href="1.0/my_package-1.0.tar.gz#sha256=abc" data-requires-python="&gt;=3.8" data-yanked="broken build">my_package-1.0.tar.gz</a>`)
+}
@@ -1,12 +1,11 @@
 package middleware
 
 import (
-	"encoding/json"
 	"fmt"
-	"io"
 	"log/slog"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/pfernandom/go-pypi/pipy"
 )
@@ -24,8 +23,7 @@ func PyPiCacheMiddleware(next http.Handler) http.Handler {
 			err := pipy.HandleProxyFileDownload(w, r, next)
 			if err != nil {
 				pipy.Logger.Error("Failed to handle proxy file download", "error", err)
-				http.Error(w, fmt.Sprintf("Failed to handle proxy file download: %v", err), http.StatusInternalServerError)
-				next.ServeHTTP(w, r)
+				writeError(w, "Failed to handle proxy file download", err)
 				return
 			}
 		}
@@ -35,11 +33,57 @@ func PyPiCacheMiddleware(next http.Handler) http.Handler {
 
 type PyPiConfig struct {
 	MaxFileSizeMB int64
+	// Where packages are stored, defaults to the local file system
+	Storage pipy.Storage
+	// Path of the metadata database, defaults to ./index.db. Each replica has its own, only
+	// projects missing from it are looked up in the storage.
+	IndexPath string
+	// Bearer token required by the /admin/ endpoints, they are disabled if empty
+	AdminToken string
+	// Whether uploads may replace existing files, defaults to immutable
+	OverwritePolicy pipy.OverwritePolicy
+	// Indexes proxied for projects that aren't hosted locally, in priority order. Defaults
+	// to pypi.org.
+	Upstreams []pipy.UpstreamConfig
+	// Project names or globs (e.g. "acme-*") that are never proxied
+	ReservedProjects []string
+	// Never proxies files of projects that have uploaded files, even merged ones
+	IsolateLocalProjects bool
+	// Project names or globs whose uploaded files are listed along with the upstream ones
+	MergedProjects []string
+	// How long upstream simple pages are cached, defaults to 10 minutes if nil
+	DescriptorCacheTTL *time.Duration
+	// How long expired simple pages are served while revalidated, defaults to 24 hours if nil
+	DescriptorStaleWhileRevalidate *time.Duration
+	// Never asks the upstreams, only serves what was cached
+	Offline bool
 }
 
 func NewPyPiMux(config *PyPiConfig) *http.ServeMux {
-	pipy.SetupStorage()
+	pipy.SetupStorage(config.Storage)
+	if err := pipy.SetupIndex(config.IndexPath); err != nil {
+		logger.Error("Failed to open index", "error", err)
+		panic(err)
+	}
+	if err := pipy.SetupOverwritePolicy(config.OverwritePolicy); err != nil {
+		panic(err)
+	}
+	if err := pipy.SetupUpstreams(config.Upstreams); err != nil {
+		logger.Error("Failed to configure upstream", "error", err)
+		panic(err)
+	}
+	if err := pipy.SetupProxyProtection(config.ReservedProjects, config.IsolateLocalProjects); err != nil {
+		panic(err)
+	}
+	if err := pipy.SetupMergedProjects(config.MergedProjects); err != nil {
+		panic(err)
+	}
+	if err := pipy.SetupDescriptorCache(config.DescriptorCacheTTL, config.DescriptorStaleWhileRevalidate); err != nil {
+		panic(err)
+	}
+	pipy.SetupOfflineMode(config.Offline)
 	mux := http.NewServeMux()
+	fileServer := pipy.FileServer()
 
 	mid := MultiMiddleware{}.
 		WithMiddleware(ErrorHandler)
@@ -51,11 +95,72 @@ func NewPyPiMux(config *PyPiConfig) *http.ServeMux {
 			http.Error(w, fmt.Sprintf("Failed to get index response: %v", err), http.StatusInternalServerError)
 			return
 		}
-		w.Header().Set("Content-Type", "application/vnd.pypi.simple.v1+json")
-		json.NewEncoder(w).Encode(response)
+		writeIndex(w, r, response)
 	}))
 
-	mux.Handle("POST /simple/", mid.HandleFunc(func(w http.ResponseWriter, r *http.Request) {
+	upload := mid.HandleFunc(handleUpload(config))
+	// Twine posts to the repository URL, e.g. --repository-url .../legacy/
+	mux.Handle("POST /{$}", upload)
+	mux.Handle("POST /legacy/", upload)
+	mux.Handle("POST /simple/", upload)
+
+	mux.Handle("GET /simple/{package}/", mid.HandleFunc(func(w http.ResponseWriter, r *http.Request) {
+		repo := r.PathValue("package")
+		logger.Debug("Getting repo", "repo", repo)
+
+		files, err := pipy.GetPackageDescriptor(repo)
+		if err == pipy.RepoNotFound {
+			files, err = pipy.GetProxyDescriptor(repo)
+			if err == pipy.RepoNotFound {
+				http.NotFound(w, r)
+				return
+			}
+			if err != nil {
+				logger.Error("Failed to get file from PyPI", "error", err)
+				writeError(w, "Failed to get file from PyPI", err)
+				return
+			}
+		} else if err != nil {
+			logger.Error("Failed to get repo", "error", err)
+			http.Error(w, fmt.Sprintf("Failed to get repo: %v", err), http.StatusInternalServerError)
+			return
+		} else {
+			files = pipy.MergeUpstreamFiles(files)
+		}
+
+		writeDescriptor(w, r, files)
+	}))
+	mux.Handle("GET /simple/{package}/{version}/{filename}", mid.HandleFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger.Debug("Handling get filename", "path", r.URL.Path)
+		repo, version, filename := r.PathValue("package"), r.PathValue("version"), r.PathValue("filename")
+
+		key, err := pipy.FileKey(repo, version, filename)
+		if err != nil {
+			logger.Error("Failed to get file in Handling get filename", "error", err)
+			writeError(w, "Failed to get file", err)
+			return
+		}
+		// Served like the proxied files, with Range and conditional requests
+		r.URL.Path = "/" + key
+		fileServer.ServeHTTP(w, r)
+	}))
+
+	admin := mid.WithMiddleware(adminAuth(config)).HandleFunc(handleYank)
+	mux.Handle("POST /admin/{package}/{version}/yank", admin)
+	mux.Handle("DELETE /admin/{package}/{version}/yank", admin)
+	mux.Handle("POST /admin/{package}/{version}/{filename}/yank", admin)
+	mux.Handle("DELETE /admin/{package}/{version}/{filename}/yank", admin)
+
+	mux.Handle("/proxy/", PyPiCacheMiddleware(
+		fileServer,
+	))
+
+	return mux
+}
+
+// Handles uploads through the legacy upload API used by twine
+func handleUpload(config *PyPiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		// Parse the multipart form with a maximum memory limit (e.g., 32MB)
 		err := r.ParseMultipartForm(config.MaxFileSizeMB << 20) // 32 MB
 		if err != nil {
@@ -67,7 +172,7 @@ func NewPyPiMux(config *PyPiConfig) *http.ServeMux {
 		parsedRequest, err := pipy.ParseUploadRequestFrom(&r.Form)
 		if err != nil {
 			logger.Error("Failed to parse upload request", "error", err)
-			http.Error(w, "Failed to parse upload request", http.StatusBadRequest)
+			writeError(w, "Failed to parse upload request", err)
 			return
 		}
 
@@ -75,7 +180,7 @@ func NewPyPiMux(config *PyPiConfig) *http.ServeMux {
 		err = pipy.SavePublishRequestFile(parsedRequest, r)
 		if err != nil {
 			logger.Error("Failed to save file", "error", err)
-			http.Error(w, fmt.Sprintf("Failed to save file: %v", err), http.StatusInternalServerError)
+			writeError(w, "Failed to save file", err)
 			return
 		}
 
@@ -83,52 +188,9 @@ func NewPyPiMux(config *PyPiConfig) *http.ServeMux {
 		err = pipy.SaveUploadRequestData(parsedRequest)
 		if err != nil {
 			logger.Error("Failed to save upload request data", "error", err)
-			http.Error(w, fmt.Sprintf("Failed to save upload request data: %v", err), http.StatusInternalServerError)
+			writeError(w, "Failed to save upload request data", err)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
-	}))
-
-	mux.Handle("GET /simple/{package}/", mid.HandleFunc(func(w http.ResponseWriter, r *http.Request) {
-		repo := r.PathValue("package")
-		logger.Debug("Getting repo", "repo", repo)
-
-		files, err := pipy.GetPackageDescriptor(repo)
-		if err != nil {
-			if err == pipy.RepoNotFound {
-				pipy.HandleProxyGetDescriptor(repo, w, r)
-				return
-			} else {
-				logger.Error("Failed to get repo", "error", err)
-				http.Error(w, fmt.Sprintf("Failed to get repo: %v", err), http.StatusInternalServerError)
-			}
-			return
-		}
-
-		w.Header().Set("Content-Type", "application/vnd.pypi.simple.v1+json")
-		json.NewEncoder(w).Encode(files)
-	}))
-	mux.Handle("GET /simple/{package}/{version}/{filename}", mid.HandleFunc(func(w http.ResponseWriter, r *http.Request) {
-		logger.Debug("Handling get filename", "path", r.URL.Path)
-		repo, version, filename := r.PathValue("package"), r.PathValue("version"), r.PathValue("filename")
-
-		file, err := pipy.GetFile(repo, version, filename)
-		if err != nil {
-			logger.Error("Failed to get file in Handling get filename", "error", err)
-			http.Error(w, fmt.Sprintf("Failed to get file: %v", err), http.StatusInternalServerError)
-			return
-		}
-		_, err = io.Copy(w, file)
-		if err != nil {
-			logger.Error("Failed to copy file", "error", err)
-			http.Error(w, fmt.Sprintf("Failed to copy file: %v", err), http.StatusInternalServerError)
-			return
-		}
-	}))
-
-	mux.Handle("/proxy/", PyPiCacheMiddleware(
-		http.FileServer(http.Dir("uploads")),
-	))
-
-	return mux
+	}
 }
@@ -1,17 +1,111 @@
 package middleware
 
 import (
+	"bytes"
+	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/pfernandom/go-pypi/pipy"
 	"github.com/stretchr/testify/assert"
 )
 
+func durationOf(d time.Duration) *time.Duration {
+	return &d
+}
+
+// Upload time of the files of the fake upstream
+var fakeUploadTime = "2024-01-02T03:04:05.123456Z"
+
+// Serves a simple index of the given files, keyed by project, with the file URLs pointing
+// to /packages/<hash dirs>/<filename> on the same server
+func newFakeUpstream(t *testing.T, projects map[string]map[string][]byte) *httptest.Server {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	mux.HandleFunc("GET /simple/{project}/", func(w http.ResponseWriter, r *http.Request) {
+		files, ok := projects[r.PathValue("project")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		response := pipy.Response{Meta: pipy.Meta{ApiVersion: "1.1"}, Name: r.PathValue("project"), Versions: []string{}, Files: []pipy.File{}}
+		for filename, content := range files {
+			if data, err := pipy.ParseProjectData(filename); err == nil && !slices.Contains(response.Versions, data.Version) {
+				response.Versions = append(response.Versions, data.Version)
+			}
+			response.Files = append(response.Files, pipy.File{
+				Filename:   filename,
+				URL:        server.URL + "/packages/b5/f4/" + filename,
+				Hashes:     pipy.FileHashes{SHA256: pipy.CalculateSHA256(content)},
+				UploadTime: &fakeUploadTime,
+			})
+		}
+		w.Header().Set("Content-Type", "application/vnd.pypi.simple.v1+json")
+		json.NewEncoder(w).Encode(response)
+	})
+	mux.HandleFunc("GET /packages/{path...}", func(w http.ResponseWriter, r *http.Request) {
+		for _, files := range projects {
+			if content, ok := files[path.Base(r.URL.Path)]; ok {
+				w.Write(content)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	})
+	return server
+}
+
+// Serves a simple index listing the given files, by filename with their sha256 if known, with
+// the file URLs pointing to /packages/b5/f4/<filename>. Files and the pages of projects
+// without files are served by serve.
+func newListingUpstream(t *testing.T, hashes map[string]string, serve http.HandlerFunc) *httptest.Server {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	mux.HandleFunc("GET /simple/{project}/", func(w http.ResponseWriter, r *http.Request) {
+		response := pipy.Response{Meta: pipy.Meta{ApiVersion: "1.1"}, Name: r.PathValue("project"), Versions: []string{}, Files: []pipy.File{}}
+		for filename, hash := range hashes {
+			if data, err := pipy.ParseProjectData(filename); err == nil && data.Repo == response.Name {
+				response.Files = append(response.Files, pipy.File{
+					Filename: filename,
+					URL:      server.URL + "/packages/b5/f4/" + filename,
+					Hashes:   pipy.FileHashes{SHA256: hash},
+				})
+			}
+		}
+		if len(response.Files) == 0 {
+			serve(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.pypi.simple.v1+json")
+		json.NewEncoder(w).Encode(response)
+	})
+	mux.HandleFunc("/", serve)
+	return server
+}
+
 func TestPyPiGetMux(t *testing.T) {
+	upstream := newFakeUpstream(t, map[string]map[string][]byte{
+		"numpy": {"numpy-2.3.4.tar.gz": []byte("numpy sdist")},
+	})
+	upstreamUrl, err := url.Parse(upstream.URL)
+	assert.NoError(t, err)
 	mux := NewPyPiMux(&PyPiConfig{
 		MaxFileSizeMB: 128,
+		Storage:       pipy.NewFileSystemStorage(t.TempDir()),
+		IndexPath:     filepath.Join(t.TempDir(), "index.db"),
+		Upstreams:     []pipy.UpstreamConfig{{URL: upstream.URL + "/simple"}},
 	})
 	rootMux := http.NewServeMux()
 	rootMux.Handle("/pypi/", http.StripPrefix("/pypi", mux))
@@ -20,7 +114,8 @@ func TestPyPiGetMux(t *testing.T) {
 
 	for _, url := range []string{
 		server.URL + "/pypi/simple/",
-		server.URL + "/pypi/proxy/packages/b5/f4/098d2270d52b41f1bd7db9fc288aaa0400cb48c2a3e2af6fa365d9720947/numpy-2.3.4.tar.gz?originalHost=pypi.org&originalScheme=https",
+		server.URL + "/pypi/simple/numpy/",
+		server.URL + "/pypi/proxy/packages/b5/f4/numpy-2.3.4.tar.gz?originalHost=" + upstreamUrl.Host + "&originalScheme=http",
 	} {
 		t.Run(url, func(t *testing.T) {
 			_ = requestAndAssertOk(t, url)
@@ -28,6 +123,38 @@ func TestPyPiGetMux(t *testing.T) {
 	}
 }
 
+func TestProxyUsesUpstream(t *testing.T) {
+	upstream := newFakeUpstream(t, map[string]map[string][]byte{
+		"numpy": {"numpy-2.3.4.tar.gz": []byte("numpy sdist")},
+	})
+	server, storage := newUploadServerWithConfig(t, &PyPiConfig{Upstreams: []pipy.UpstreamConfig{{URL: upstream.URL + "/simple/"}}})
+
+	req, err := http.NewRequest("GET", server.URL+"/simple/numpy/", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Accept", "application/vnd.pypi.simple.v1+json")
+	status, body := doRequest(t, req)
+	assert.Equal(t, http.StatusOK, status, body)
+	var descriptor pipy.Response
+	assert.NoError(t, json.Unmarshal([]byte(body), &descriptor))
+	assert.Len(t, descriptor.Files, 1)
+	fileUrl, err := descriptor.Files[0].GetUrl()
+	assert.NoError(t, err)
+	assert.Equal(t, "/proxy/packages/b5/f4/numpy-2.3.4.tar.gz", fileUrl.Path)
+
+	content := requestAndAssertOk(t, server.URL+fileUrl.Path+"?"+fileUrl.RawQuery)
+	assert.Equal(t, "numpy sdist", string(content))
+	_, err = storage.Stat("numpy/2.3.4/numpy-2.3.4.tar.gz")
+	assert.NoError(t, err)
+
+	// The upload time of the upstream is kept
+	file, err := storage.Open("numpy/2.3.4/.files/numpy-2.3.4.tar.gz.json")
+	assert.NoError(t, err)
+	defer file.Close()
+	var record pipy.FileRecord
+	assert.NoError(t, json.NewDecoder(file).Decode(&record))
+	assert.Equal(t, fakeUploadTime, record.UploadTime.Format(pipy.UploadTimeFormat))
+}
+
 func TestPyPiPostMux(t *testing.T) {
 	mux := NewPyPiMux(&PyPiConfig{
 		MaxFileSizeMB: 128,
@@ -48,3 +175,633 @@ func requestAndAssertOk(t *testing.T, url string) []byte {
 	assert.NoError(t, err)
 	return body
 }
+
+func TestGetFileRejectsTraversal(t *testing.T) {
+	server, _ := newUploadServer(t)
+	status, body := doRequest(t, newUploadRequest(t, server.URL+"/legacy/", twineFields("my-package", "1.0"), "my_package-1.0.tar.gz", newDistribution(t, "my_package-1.0.tar.gz", "")))
+	assert.Equal(t, http.StatusOK, status, body)
+
+	for _, path := range []string{
+		"/simple/my-package/1.0/..%2F..%2F..%2Fgo.mod",
+		"/simple/..%2F..%2Fmiddleware/pypi.go/x",
+		"/simple/my-package/%2E%2E/my_package-1.0.tar.gz",
+		"/simple/my-package/1.0/%252e%252e%252fgo.mod",
+		"/simple/my-package/1.0/%EF%BC%8E%EF%BC%8E%EF%BC%8Fgo.mod",
+		"/simple/my-package/.files/my_package-1.0.tar.gz.json",
+	} {
+		t.Run(path, func(t *testing.T) {
+			req, err := http.NewRequest("GET", server.URL+path, nil)
+			assert.NoError(t, err)
+			status, _ := doRequest(t, req)
+			assert.Equal(t, http.StatusBadRequest, status)
+		})
+	}
+}
+
+func TestGetFileServesRanges(t *testing.T) {
+	server, _ := newUploadServer(t)
+	content := newDistribution(t, "my_package-1.0.tar.gz", "")
+	status, body := doRequest(t, newUploadRequest(t, server.URL+"/legacy/", twineFields("my-package", "1.0"), "my_package-1.0.tar.gz", content))
+	assert.Equal(t, http.StatusOK, status, body)
+	fileUrl := server.URL + "/simple/my-package/1.0/my_package-1.0.tar.gz"
+
+	resp, err := http.Get(fileUrl)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, int64(len(content)), resp.ContentLength)
+	lastModified := resp.Header.Get("Last-Modified")
+	assert.NotEmpty(t, lastModified)
+
+	req, err := http.NewRequest("GET", fileUrl, nil)
+	assert.NoError(t, err)
+	req.Header.Set("Range", "bytes=0-9")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	partial, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, content[:10], partial)
+
+	req, err = http.NewRequest("GET", fileUrl, nil)
+	assert.NoError(t, err)
+	req.Header.Set("If-Modified-Since", lastModified)
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+}
+
+func TestProxyRoutesBetweenUpstreams(t *testing.T) {
+	private := newFakeUpstream(t, map[string]map[string][]byte{
+		"acme-widgets": {"acme_widgets-1.0.tar.gz": []byte("private acme")},
+	})
+	mirror := newFakeUpstream(t, map[string]map[string][]byte{
+		"acme-widgets": {"acme_widgets-9.0.tar.gz": []byte("mirror acme")},
+		"shared":       {"shared-1.0.tar.gz": []byte("mirror shared")},
+	})
+	public := newFakeUpstream(t, map[string]map[string][]byte{
+		"acme-widgets": {"acme_widgets-9.0.tar.gz": []byte("public acme")},
+		"shared":       {"shared-1.0.tar.gz": []byte("public shared"), "shared-2.0.tar.gz": []byte("public shared 2")},
+		"numpy":        {"numpy-2.3.4.tar.gz": []byte("numpy sdist")},
+	})
+	server, storage := newUploadServerWithConfig(t, &PyPiConfig{Upstreams: []pipy.UpstreamConfig{
+		{Name: "private", URL: private.URL + "/simple", Projects: []string{"acme-*"}},
+		{Name: "mirror", URL: mirror.URL + "/simple"},
+		{Name: "public", URL: public.URL + "/simple"},
+	}})
+
+	download := func(project string) map[string]string {
+		contents := map[string]string{}
+		for _, file := range getDescriptor(t, server, project).Files {
+			fileUrl, err := file.GetUrl()
+			assert.NoError(t, err)
+			contents[file.Filename+" "+fileUrl.Query().Get("upstream")] = string(requestAndAssertOk(t, server.URL+fileUrl.Path+"?"+fileUrl.RawQuery))
+		}
+		return contents
+	}
+
+	// acme-* projects are only taken from the private index
+	assert.Equal(t, map[string]string{"acme_widgets-1.0.tar.gz private": "private acme"}, download("acme-widgets"))
+	// The other indexes are merged, the one with the higher priority wins a filename collision
+	assert.Equal(t, map[string]string{
+		"shared-1.0.tar.gz mirror": "mirror shared",
+		"shared-2.0.tar.gz public": "public shared 2",
+	}, download("shared"))
+	assert.Equal(t, map[string]string{"numpy-2.3.4.tar.gz public": "numpy sdist"}, download("numpy"))
+
+	recordFile, err := storage.Open("shared/1.0/.files/shared-1.0.tar.gz.json")
+	assert.NoError(t, err)
+	defer recordFile.Close()
+	var record pipy.FileRecord
+	assert.NoError(t, json.NewDecoder(recordFile).Decode(&record))
+	assert.Equal(t, "mirror", record.Upstream)
+}
+
+func TestProxyProtectsInternalProjects(t *testing.T) {
+	upstream := newFakeUpstream(t, map[string]map[string][]byte{
+		"acme-widgets": {"acme_widgets-99.0.tar.gz": []byte("malicious")},
+		"shared":       {"shared-99.0.tar.gz": []byte("malicious")},
+	})
+	upstreamUrl, err := url.Parse(upstream.URL)
+	assert.NoError(t, err)
+	server, storage := newUploadServerWithConfig(t, &PyPiConfig{
+		Upstreams:            []pipy.UpstreamConfig{{URL: upstream.URL + "/simple"}},
+		ReservedProjects:     []string{"acme-*"},
+		IsolateLocalProjects: true,
+	})
+	proxyUrl := func(filename string) string {
+		return server.URL + "/proxy/packages/b5/f4/" + filename + "?originalHost=" + upstreamUrl.Host + "&originalScheme=http"
+	}
+
+	// Reserved projects are neither listed nor downloaded from upstream
+	resp, err := http.Get(server.URL + "/simple/acme-widgets/")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, err = http.Get(proxyUrl("acme_widgets-99.0.tar.gz"))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	_, err = storage.Stat("acme-widgets/99.0/acme_widgets-99.0.tar.gz")
+	assert.Equal(t, pipy.FileNotFound, err)
+
+	// Uploaded projects don't get upstream files mixed in
+	req := newUploadRequest(t, server.URL+"/legacy/", twineFields("shared", "1.0"), "shared-1.0.tar.gz", newDistribution(t, "shared-1.0.tar.gz", ""))
+	status, body := doRequest(t, req)
+	assert.Equal(t, http.StatusOK, status, body)
+	resp, err = http.Get(proxyUrl("shared-99.0.tar.gz"))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	descriptor := getDescriptor(t, server, "shared")
+	assert.Len(t, descriptor.Files, 1)
+	assert.Equal(t, "shared-1.0.tar.gz", descriptor.Files[0].Filename)
+}
+
+func TestUploadedProjectsAreServedFromTheirUploadsAlone(t *testing.T) {
+	upstream := newFakeUpstream(t, map[string]map[string][]byte{
+		"shared": {"shared-98.0.tar.gz": []byte("public shared 98"), "shared-99.0.tar.gz": []byte("public shared 99")},
+	})
+	upstreamUrl, err := url.Parse(upstream.URL)
+	assert.NoError(t, err)
+	server, storage := newUploadServerWithConfig(t, &PyPiConfig{Upstreams: []pipy.UpstreamConfig{{URL: upstream.URL + "/simple"}}})
+	proxyUrl := func(filename string) string {
+		return server.URL + "/proxy/packages/b5/f4/" + filename + "?originalHost=" + upstreamUrl.Host + "&originalScheme=http"
+	}
+
+	// Downloaded before the project was uploaded
+	assert.Equal(t, "public shared 98", string(requestAndAssertOk(t, proxyUrl("shared-98.0.tar.gz"))))
+	req := newUploadRequest(t, server.URL+"/legacy/", twineFields("shared", "1.0"), "shared-1.0.tar.gz", newDistribution(t, "shared-1.0.tar.gz", ""))
+	status, body := doRequest(t, req)
+	assert.Equal(t, http.StatusOK, status, body)
+
+	resp, err := http.Get(proxyUrl("shared-99.0.tar.gz"))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	_, err = storage.Stat("shared/99.0/shared-99.0.tar.gz")
+	assert.Equal(t, pipy.FileNotFound, err)
+
+	descriptor := getDescriptor(t, server, "shared")
+	assert.Equal(t, []string{"1.0"}, descriptor.Versions)
+	assert.Len(t, descriptor.Files, 1)
+	assert.Equal(t, "shared-1.0.tar.gz", descriptor.Files[0].Filename)
+}
+
+func TestMergedProjectsListLocalAndUpstreamFiles(t *testing.T) {
+	upstream := newFakeUpstream(t, map[string]map[string][]byte{
+		"shared": {"shared-1.0.tar.gz": []byte("public shared"), "shared-2.0.tar.gz": []byte("public shared 2")},
+		"other":  {"other-1.0.tar.gz": []byte("public other")},
+	})
+	server, _ := newUploadServerWithConfig(t, &PyPiConfig{
+		Upstreams:      []pipy.UpstreamConfig{{Name: "pypi", URL: upstream.URL + "/simple"}},
+		MergedProjects: []string{"shared"},
+	})
+	for _, project := range []string{"shared", "other"} {
+		req := newUploadRequest(t, server.URL+"/legacy/", twineFields(project, "1.0"), project+"-1.0.tar.gz", newDistribution(t, project+"-1.0.tar.gz", "local"))
+		status, body := doRequest(t, req)
+		assert.Equal(t, http.StatusOK, status, body)
+	}
+
+	descriptor := getDescriptor(t, server, "shared")
+	assert.Equal(t, []string{"1.0", "2.0"}, descriptor.Versions)
+	contents := map[string]string{}
+	for _, file := range descriptor.Files {
+		fileUrl, err := file.GetUrl()
+		assert.NoError(t, err)
+		// Uploaded files are relative to the simple page
+		if !fileUrl.IsAbs() {
+			fileUrl.Path = "/simple/shared/" + fileUrl.Path
+		}
+		contents[file.Filename+" "+file.Origin] = string(requestAndAssertOk(t, server.URL+fileUrl.Path+"?"+fileUrl.RawQuery))
+	}
+	// The uploaded file wins over the upstream one with the same name
+	assert.Equal(t, map[string]string{
+		"shared-1.0.tar.gz local": string(newDistribution(t, "shared-1.0.tar.gz", "local")),
+		"shared-2.0.tar.gz pypi":  "public shared 2",
+	}, contents)
+
+	// Projects that aren't merged only list their uploaded files
+	descriptor = getDescriptor(t, server, "other")
+	assert.Len(t, descriptor.Files, 1)
+	assert.Equal(t, "", descriptor.Files[0].Origin)
+
+	req, err := http.NewRequest("GET", server.URL+"/simple/shared/", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Accept", "text/html")
+	status, body := doRequest(t, req)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, `data-origin="local">shared-1.0.tar.gz</a>`)
+	assert.Contains(t, body, `data-origin="pypi">shared-2.0.tar.gz</a>`)
+}
+
+func TestProxyFailsOpenWhenUpstreamIsDown(t *testing.T) {
+	upstream := newFakeUpstream(t, map[string]map[string][]byte{
+		"numpy": {"numpy-2.3.4.tar.gz": []byte("numpy sdist")},
+		"scipy": {"scipy-1.16.0.tar.gz": []byte("scipy sdist")},
+	})
+	server, storage := newUploadServerWithConfig(t, &PyPiConfig{
+		Upstreams:                      []pipy.UpstreamConfig{{URL: upstream.URL + "/simple"}},
+		DescriptorCacheTTL:             durationOf(0),
+		DescriptorStaleWhileRevalidate: durationOf(0),
+	})
+	getSimplePage := func(project string) (*http.Response, pipy.Response) {
+		req, err := http.NewRequest("GET", server.URL+"/simple/"+project+"/", nil)
+		assert.NoError(t, err)
+		req.Header.Set("Accept", "application/vnd.pypi.simple.v1+json")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		var descriptor pipy.Response
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&descriptor))
+		return resp, descriptor
+	}
+
+	resp, descriptor := getSimplePage("numpy")
+	assert.Equal(t, "", resp.Header.Get("X-Upstream-Stale"))
+	fileUrl, err := descriptor.Files[0].GetUrl()
+	assert.NoError(t, err)
+	requestAndAssertOk(t, server.URL+fileUrl.Path+"?"+fileUrl.RawQuery)
+	// Downloaded by another replica sharing the storage, without caching its simple page here
+	upstreamUrl, err := url.Parse(upstream.URL)
+	assert.NoError(t, err)
+	record, err := json.Marshal(pipy.FileRecord{
+		Filename: "scipy-1.16.0.tar.gz",
+		Size:     int64(len("scipy sdist")),
+		Hashes:   pipy.FileDigests{SHA256: pipy.CalculateSHA256([]byte("scipy sdist"))},
+		Upstream: upstreamUrl.Host,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, storage.Put("scipy/1.16.0/scipy-1.16.0.tar.gz", bytes.NewReader([]byte("scipy sdist"))))
+	assert.NoError(t, storage.Put("scipy/1.16.0/.files/scipy-1.16.0.tar.gz.json", bytes.NewReader(record)))
+
+	upstream.Close()
+
+	// The last simple page of the upstream is served
+	resp, descriptor = getSimplePage("numpy")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "true", resp.Header.Get("X-Upstream-Stale"))
+	assert.Equal(t, "numpy-2.3.4.tar.gz", descriptor.Files[0].Filename)
+
+	// Without one, the files downloaded before are listed
+	resp, descriptor = getSimplePage("scipy")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "true", resp.Header.Get("X-Upstream-Stale"))
+	assert.Len(t, descriptor.Files, 1)
+	assert.Equal(t, "scipy-1.16.0.tar.gz", descriptor.Files[0].Filename)
+	assert.Equal(t, "scipy sdist", string(requestAndAssertOk(t, server.URL+"/simple/scipy/"+descriptor.Files[0].URL)))
+}
+
+func TestProxyStreamsDownloads(t *testing.T) {
+	content := bytes.Repeat([]byte("wheel"), 100000)
+	var requests atomic.Int32
+	release := make(chan struct{})
+	upstream := newListingUpstream(t, map[string]string{"numpy-2.3.4.tar.gz": ""}, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content[:100000])
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write(content[100000:])
+	})
+	upstreamUrl, err := url.Parse(upstream.URL)
+	assert.NoError(t, err)
+	server, storage := newUploadServerWithConfig(t, &PyPiConfig{Upstreams: []pipy.UpstreamConfig{{URL: upstream.URL + "/simple"}}})
+	proxyUrl := server.URL + "/proxy/packages/b5/f4/numpy-2.3.4.tar.gz?originalHost=" + upstreamUrl.Host + "&originalScheme=http"
+
+	// The beginning of the file is sent before the upstream finishes
+	first, err := http.Get(proxyUrl)
+	assert.NoError(t, err)
+	defer first.Body.Close()
+	assert.Equal(t, int64(len(content)), first.ContentLength)
+	start := make([]byte, 500)
+	_, err = io.ReadFull(first.Body, start)
+	assert.NoError(t, err)
+	assert.Equal(t, content[:500], start)
+
+	// Other requesters attach to the download in progress
+	second, err := http.Get(proxyUrl)
+	assert.NoError(t, err)
+	defer second.Body.Close()
+	_, err = io.ReadFull(second.Body, start)
+	assert.NoError(t, err)
+	assert.Equal(t, content[:500], start)
+	_, err = storage.Stat("numpy/2.3.4/numpy-2.3.4.tar.gz")
+	assert.Equal(t, pipy.FileNotFound, err)
+	close(release)
+
+	for _, resp := range []*http.Response{first, second} {
+		rest, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, content[500:], rest)
+	}
+	assert.Equal(t, int32(1), requests.Load())
+	assert.Eventually(t, func() bool {
+		_, err := storage.Stat("numpy/2.3.4/numpy-2.3.4.tar.gz")
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, content, requestAndAssertOk(t, proxyUrl))
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestProxyDoesNotCacheTruncatedDownloads(t *testing.T) {
+	upstream := newListingUpstream(t, map[string]string{"numpy-2.3.4.tar.gz": ""}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		w.Write(bytes.Repeat([]byte("x"), 500))
+	})
+	upstreamUrl, err := url.Parse(upstream.URL)
+	assert.NoError(t, err)
+	server, storage := newUploadServerWithConfig(t, &PyPiConfig{Upstreams: []pipy.UpstreamConfig{{URL: upstream.URL + "/simple"}}})
+
+	// Depending on how much was streamed, the requester gets an error status or a broken response
+	resp, err := http.Get(server.URL + "/proxy/packages/b5/f4/numpy-2.3.4.tar.gz?originalHost=" + upstreamUrl.Host + "&originalScheme=http")
+	if err == nil {
+		defer resp.Body.Close()
+		_, err = io.ReadAll(resp.Body)
+		assert.True(t, err != nil || resp.StatusCode != http.StatusOK)
+	}
+	_, err = storage.Stat("numpy/2.3.4/numpy-2.3.4.tar.gz")
+	assert.Equal(t, pipy.FileNotFound, err)
+}
+
+func TestProxyVerifiesDownloadHashes(t *testing.T) {
+	content := []byte("numpy sdist")
+	hashes := map[string]string{"numpy-2.3.4.tar.gz": pipy.CalculateSHA256([]byte("tampered"))}
+	upstream := newListingUpstream(t, hashes, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	})
+	upstreamUrl, err := url.Parse(upstream.URL)
+	assert.NoError(t, err)
+	server, storage := newUploadServerWithConfig(t, &PyPiConfig{
+		Upstreams:                      []pipy.UpstreamConfig{{URL: upstream.URL + "/simple"}},
+		DescriptorCacheTTL:             durationOf(0),
+		DescriptorStaleWhileRevalidate: durationOf(0),
+		// Uploaded files are only proxied alongside the upstream ones if merged
+		MergedProjects: []string{"numpy"},
+	})
+	fileUrl := server.URL + "/proxy/packages/b5/f4/numpy-2.3.4.tar.gz?originalHost=" + upstreamUrl.Host + "&originalScheme=http"
+
+	// A download not matching the listed hash fails and isn't cached
+	resp, err := http.Get(fileUrl)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	_, err = storage.Stat("numpy/2.3.4/numpy-2.3.4.tar.gz")
+	assert.Equal(t, pipy.FileNotFound, err)
+
+	hashes["numpy-2.3.4.tar.gz"] = pipy.CalculateSHA256(content)
+	assert.Equal(t, "numpy sdist", string(requestAndAssertOk(t, fileUrl)))
+
+	// A cached file not matching the listed hash is downloaded again
+	content = []byte("rebuilt numpy sdist")
+	hashes["numpy-2.3.4.tar.gz"] = pipy.CalculateSHA256(content)
+	assert.Equal(t, "rebuilt numpy sdist", string(requestAndAssertOk(t, fileUrl)))
+	assert.Equal(t, "rebuilt numpy sdist", string(requestAndAssertOk(t, fileUrl)))
+
+	// Uploaded files are never replaced, whatever the upstream lists or the proxy URL says
+	uploaded := newDistribution(t, "numpy-2.3.5.tar.gz", "")
+	status, body := doRequest(t, newUploadRequest(t, server.URL+"/legacy/", twineFields("numpy", "2.3.5"), "numpy-2.3.5.tar.gz", uploaded))
+	assert.Equal(t, http.StatusOK, status, body)
+	hashes["numpy-2.3.5.tar.gz"] = pipy.CalculateSHA256(content)
+	for _, host := range []string{upstreamUrl.Host, "attacker.example"} {
+		uploadedUrl := server.URL + "/proxy/packages/b5/f4/numpy-2.3.5.tar.gz?originalHost=" + host + "&originalScheme=http"
+		assert.Equal(t, uploaded, requestAndAssertOk(t, uploadedUrl))
+	}
+	file, err := storage.Open("numpy/2.3.5/numpy-2.3.5.tar.gz")
+	assert.NoError(t, err)
+	defer file.Close()
+	stored, err := io.ReadAll(file)
+	assert.NoError(t, err)
+	assert.Equal(t, uploaded, stored)
+}
+
+func TestProxyVerifiesCoreMetadataHashes(t *testing.T) {
+	listed := []byte("Metadata-Version: 2.1\nName: numpy\nVersion: 2.3.4\n")
+	served := []byte("Metadata-Version: 2.1\nName: numpy\nVersion: 2.3.4\nRequires-Dist: malicious\n")
+	mux := http.NewServeMux()
+	upstream := httptest.NewServer(mux)
+	t.Cleanup(upstream.Close)
+	mux.HandleFunc("GET /simple/numpy/", func(w http.ResponseWriter, r *http.Request) {
+		var coreMetadata any = map[string]string{"sha256": pipy.CalculateSHA256(listed)}
+		json.NewEncoder(w).Encode(pipy.Response{Name: "numpy", Files: []pipy.File{{
+			Filename:     "numpy-2.3.4-py3-none-any.whl",
+			URL:          upstream.URL + "/packages/b5/f4/numpy-2.3.4-py3-none-any.whl",
+			CoreMetadata: &coreMetadata,
+		}}})
+	})
+	mux.HandleFunc("GET /packages/b5/f4/numpy-2.3.4-py3-none-any.whl.metadata", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(served)
+	})
+	upstreamUrl, err := url.Parse(upstream.URL)
+	assert.NoError(t, err)
+	server, storage := newUploadServerWithConfig(t, &PyPiConfig{Upstreams: []pipy.UpstreamConfig{{URL: upstream.URL + "/simple"}}})
+	metadataUrl := server.URL + "/proxy/packages/b5/f4/numpy-2.3.4-py3-none-any.whl.metadata?originalHost=" + upstreamUrl.Host + "&originalScheme=http"
+
+	// Metadata not matching the listed hash fails and isn't cached
+	resp, err := http.Get(metadataUrl)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	_, err = storage.Stat("numpy/2.3.4/.files/numpy-2.3.4-py3-none-any.whl.metadata")
+	assert.Equal(t, pipy.FileNotFound, err)
+
+	served = listed
+	assert.Equal(t, listed, requestAndAssertOk(t, metadataUrl))
+	_, err = storage.Stat("numpy/2.3.4/.files/numpy-2.3.4-py3-none-any.whl.metadata")
+	assert.NoError(t, err)
+}
+
+func TestProxyOnlyDownloadsListedFiles(t *testing.T) {
+	upstream := newFakeUpstream(t, map[string]map[string][]byte{
+		"numpy": {"numpy-2.3.4.tar.gz": []byte("numpy sdist")},
+	})
+	var requests atomic.Int32
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte("malicious"))
+	}))
+	t.Cleanup(other.Close)
+	otherUrl, err := url.Parse(other.URL)
+	assert.NoError(t, err)
+	server, storage := newUploadServerWithConfig(t, &PyPiConfig{Upstreams: []pipy.UpstreamConfig{{URL: upstream.URL + "/simple"}}})
+
+	for _, test := range []struct {
+		path     string
+		filename string
+	}{
+		{"/proxy/x/requests-2.0.0.tar.gz", "requests/2.0.0/requests-2.0.0.tar.gz"},
+		{"/proxy/packages/b5/f4/numpy-2.3.4.tar.gz", "numpy/2.3.4/numpy-2.3.4.tar.gz"},
+		{"/proxy/packages/b5/f4/numpy-2.3.4.tar.gz.metadata", "numpy/2.3.4/.files/numpy-2.3.4.tar.gz.metadata"},
+	} {
+		t.Run(test.path, func(t *testing.T) {
+			resp, err := http.Get(server.URL + test.path + "?originalHost=" + otherUrl.Host + "&originalScheme=http")
+			assert.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+			_, err = storage.Stat(test.filename)
+			assert.Equal(t, pipy.FileNotFound, err)
+		})
+	}
+	assert.Equal(t, int32(0), requests.Load())
+	assert.NotContains(t, string(requestAndAssertOk(t, server.URL+"/simple/")), "requests")
+}
+
+func TestProxyPropagatesUpstreamErrors(t *testing.T) {
+	listed := map[string]string{"numpy-2.3.4.tar.gz": "", "numpy-2.3.5.tar.gz": "", "numpy-2.3.6.tar.gz": "", "numpy-2.3.4-py3-none-any.whl": ""}
+	upstream := newListingUpstream(t, listed, func(w http.ResponseWriter, r *http.Request) {
+		switch path.Base(r.URL.Path) {
+		case "numpy-2.3.4.tar.gz", "pandas":
+			http.Error(w, "<html>Service Unavailable</html>", http.StatusServiceUnavailable)
+		case "numpy-2.3.5.tar.gz":
+			time.Sleep(500 * time.Millisecond)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	upstreamUrl, err := url.Parse(upstream.URL)
+	assert.NoError(t, err)
+	server, storage := newUploadServerWithConfig(t, &PyPiConfig{Upstreams: []pipy.UpstreamConfig{{URL: upstream.URL + "/simple", Timeout: 100 * time.Millisecond}}})
+
+	for _, test := range []struct {
+		path     string
+		status   int
+		filename string
+	}{
+		{"/simple/pandas/", http.StatusBadGateway, ""},
+		{"/simple/scipy/", http.StatusNotFound, ""},
+		{"/proxy/packages/b5/f4/numpy-2.3.4.tar.gz", http.StatusBadGateway, "numpy/2.3.4/numpy-2.3.4.tar.gz"},
+		{"/proxy/packages/b5/f4/numpy-2.3.5.tar.gz", http.StatusGatewayTimeout, "numpy/2.3.5/numpy-2.3.5.tar.gz"},
+		{"/proxy/packages/b5/f4/numpy-2.3.6.tar.gz", http.StatusNotFound, "numpy/2.3.6/numpy-2.3.6.tar.gz"},
+		{"/proxy/packages/b5/f4/numpy-2.3.4-py3-none-any.whl.metadata", http.StatusNotFound, ""},
+	} {
+		t.Run(test.path, func(t *testing.T) {
+			resp, err := http.Get(server.URL + test.path + "?originalHost=" + upstreamUrl.Host + "&originalScheme=http")
+			assert.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, test.status, resp.StatusCode)
+			if test.filename != "" {
+				_, err = storage.Stat(test.filename)
+				assert.Equal(t, pipy.FileNotFound, err)
+			}
+		})
+	}
+}
+
+func TestProxyDeduplicatesConcurrentFetches(t *testing.T) {
+	content := []byte("numpy sdist")
+	var pageRequests, fileRequests atomic.Int32
+	releasePage, releaseFile := make(chan struct{}), make(chan struct{})
+	mux := http.NewServeMux()
+	upstream := httptest.NewServer(mux)
+	t.Cleanup(upstream.Close)
+	mux.HandleFunc("GET /simple/numpy/", func(w http.ResponseWriter, r *http.Request) {
+		pageRequests.Add(1)
+		<-releasePage
+		json.NewEncoder(w).Encode(pipy.Response{Name: "numpy", Files: []pipy.File{{
+			Filename: "numpy-2.3.4.tar.gz",
+			URL:      upstream.URL + "/packages/b5/f4/numpy-2.3.4.tar.gz",
+		}}})
+	})
+	mux.HandleFunc("GET /packages/b5/f4/numpy-2.3.4.tar.gz", func(w http.ResponseWriter, r *http.Request) {
+		fileRequests.Add(1)
+		<-releaseFile
+		w.Write(content)
+	})
+	server, _ := newUploadServerWithConfig(t, &PyPiConfig{Upstreams: []pipy.UpstreamConfig{{URL: upstream.URL + "/simple"}}})
+
+	concurrently := func(request func()) {
+		var wg sync.WaitGroup
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				request()
+			}()
+		}
+		wg.Wait()
+	}
+	// Gives the requesters time to pile up on the upstream request
+	releaseLater := func(release chan struct{}) {
+		time.Sleep(200 * time.Millisecond)
+		close(release)
+	}
+	go releaseLater(releasePage)
+	var fileUrl *url.URL
+	var fileUrlOnce sync.Once
+	concurrently(func() {
+		descriptor := getDescriptor(t, server, "numpy")
+		fileUrlOnce.Do(func() {
+			fileUrl, _ = descriptor.Files[0].GetUrl()
+		})
+	})
+	assert.Equal(t, int32(1), pageRequests.Load())
+
+	go releaseLater(releaseFile)
+	concurrently(func() {
+		assert.Equal(t, content, requestAndAssertOk(t, server.URL+fileUrl.Path+"?"+fileUrl.RawQuery))
+	})
+	assert.Equal(t, int32(1), fileRequests.Load())
+}
+
+// Storage whose Stat of a key waits until released, signaling when it starts waiting
+type blockingStatStorage struct {
+	pipy.Storage
+	key     string
+	once    *sync.Once
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s blockingStatStorage) Stat(key string) (*pipy.ObjectInfo, error) {
+	if key == s.key {
+		s.once.Do(func() { close(s.entered) })
+		<-s.release
+	}
+	return s.Storage.Stat(key)
+}
+
+func TestProxyDownloadsDoNotWaitForOtherFiles(t *testing.T) {
+	upstream := newFakeUpstream(t, map[string]map[string][]byte{
+		"numpy": {"numpy-2.3.4.tar.gz": []byte("numpy sdist")},
+		"scipy": {"scipy-1.16.0.tar.gz": []byte("scipy sdist")},
+	})
+	upstreamUrl, err := url.Parse(upstream.URL)
+	assert.NoError(t, err)
+	storage := blockingStatStorage{
+		Storage: pipy.NewFileSystemStorage(t.TempDir()),
+		key:     "numpy/2.3.4/numpy-2.3.4.tar.gz",
+		once:    &sync.Once{},
+		entered: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	server := httptest.NewServer(NewPyPiMux(&PyPiConfig{
+		MaxFileSizeMB: 128,
+		Storage:       storage,
+		IndexPath:     filepath.Join(t.TempDir(), "index.db"),
+		Upstreams:     []pipy.UpstreamConfig{{URL: upstream.URL + "/simple"}},
+	}))
+	t.Cleanup(server.Close)
+	proxyUrl := func(filename string) string {
+		return server.URL + "/proxy/packages/b5/f4/" + filename + "?originalHost=" + upstreamUrl.Host + "&originalScheme=http"
+	}
+
+	numpy := make(chan []byte, 1)
+	go func() {
+		numpy <- requestAndAssertOk(t, proxyUrl("numpy-2.3.4.tar.gz"))
+	}()
+	<-storage.entered
+	// Another file is downloaded while the storage is slow to answer for the first one
+	scipy := make(chan []byte, 1)
+	go func() {
+		scipy <- requestAndAssertOk(t, proxyUrl("scipy-1.16.0.tar.gz"))
+	}()
+	select {
+	case content := <-scipy:
+		assert.Equal(t, "scipy sdist", string(content))
+	case <-time.After(5 * time.Second):
+		t.Error("the download of scipy waited for the storage check of numpy")
+	}
+	close(storage.release)
+	assert.Equal(t, "numpy sdist", string(<-numpy))
+}
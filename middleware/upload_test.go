@@ -0,0 +1,455 @@
+package middleware
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pfernandom/go-pypi/pipy"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Builds a multipart upload request the way twine does
+func newUploadRequest(t *testing.T, target string, fields url.Values, filename string, content []byte) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for key, values := range fields {
+		for _, value := range values {
+			assert.NoError(t, writer.WriteField(key, value))
+		}
+	}
+	if filename != "" {
+		part, err := writer.CreateFormFile("content", filename)
+		assert.NoError(t, err)
+		_, err = part.Write(content)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, writer.Close())
+	req, err := http.NewRequest("POST", target, body)
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func twineFields(name string, version string) url.Values {
+	return url.Values{
+		":action":          {"file_upload"},
+		"protocol_version": {"1"},
+		"name":             {name},
+		"version":          {version},
+		"filetype":         {"sdist"},
+		"pyversion":        {"source"},
+		"metadata_version": {"2.1"},
+		"summary":          {"A test package"},
+		"description":      {"# My package"},
+		"keywords":         {"test,package"},
+		"license":          {"MIT"},
+		"classifiers":      {"Programming Language :: Python :: 3", "License :: OSI Approved :: MIT License"},
+		"requires_dist":    {"requests>=2", "click"},
+		"project_urls":     {"Homepage, https://example.com"},
+		"requires_python":  {">=3.8"},
+	}
+}
+
+func newUploadServer(t *testing.T) (*httptest.Server, pipy.Storage) {
+	return newUploadServerWithConfig(t, &PyPiConfig{})
+}
+
+// Starts a server with temporary storage and index, on top of config
+func newUploadServerWithConfig(t *testing.T, config *PyPiConfig) (*httptest.Server, pipy.Storage) {
+	storage := pipy.NewFileSystemStorage(t.TempDir())
+	config.MaxFileSizeMB = 128
+	config.Storage = storage
+	config.IndexPath = filepath.Join(t.TempDir(), "index.db")
+	server := httptest.NewServer(NewPyPiMux(config))
+	t.Cleanup(server.Close)
+	return server, storage
+}
+
+func doRequest(t *testing.T, req *http.Request) (int, string) {
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
+
+func TestLegacyUpload(t *testing.T) {
+	server, storage := newUploadServer(t)
+
+	for _, path := range []string{"/", "/legacy/", "/simple/"} {
+		req := newUploadRequest(t, server.URL+path, twineFields("My_Package", "1.0"), "my_package-1.0.tar.gz", newDistribution(t, "my_package-1.0.tar.gz", ""))
+		status, body := doRequest(t, req)
+		assert.Equal(t, http.StatusOK, status, body)
+	}
+
+	file, err := storage.Open("my-package/1.0/my_package-1.0.tar.gz")
+	assert.NoError(t, err)
+	file.Close()
+
+	requestFile, err := storage.Open("my-package/1.0/request.json")
+	assert.NoError(t, err)
+	defer requestFile.Close()
+	var saved pipy.UploadRequestForm
+	assert.NoError(t, json.NewDecoder(requestFile).Decode(&saved))
+	assert.Equal(t, "my-package", saved.Name)
+	assert.Equal(t, "# My package", saved.Description)
+	assert.Equal(t, "MIT", saved.License)
+	assert.Equal(t, []string{"Programming Language :: Python :: 3", "License :: OSI Approved :: MIT License"}, saved.Classifiers)
+	assert.Equal(t, []string{"requests>=2", "click"}, saved.RequiresDist)
+	assert.Equal(t, []string{"Homepage, https://example.com"}, saved.ProjectUrls)
+}
+
+func TestLegacyUploadInvalidMetadata(t *testing.T) {
+	server, _ := newUploadServer(t)
+
+	tests := map[string]func(fields url.Values){
+		"unknown action":     func(fields url.Values) { fields.Set(":action", "submit") },
+		"missing version":    func(fields url.Values) { fields.Del("version") },
+		"invalid name":       func(fields url.Values) { fields.Set("name", "-invalid name") },
+		"unknown filetype":   func(fields url.Values) { fields.Set("filetype", "tarball") },
+		"unknown metadata":   func(fields url.Values) { fields.Set("metadata_version", "9.9") },
+		"invalid sha256":     func(fields url.Values) { fields.Set("sha256_digest", "not-a-digest") },
+		"invalid md5 length": func(fields url.Values) { fields.Set("md5_digest", "abcd") },
+		"invalid version":    func(fields url.Values) { fields.Set("version", "latest") },
+		"invalid python":     func(fields url.Values) { fields.Set("requires_python", "python3") },
+	}
+	for name, mutate := range tests {
+		t.Run(name, func(t *testing.T) {
+			fields := twineFields("my-package", "1.0")
+			mutate(fields)
+			status, _ := doRequest(t, newUploadRequest(t, server.URL+"/legacy/", fields, "my_package-1.0.tar.gz", newDistribution(t, "my_package-1.0.tar.gz", "")))
+			assert.Equal(t, http.StatusBadRequest, status)
+		})
+	}
+
+	t.Run("missing content", func(t *testing.T) {
+		status, body := doRequest(t, newUploadRequest(t, server.URL+"/legacy/", twineFields("my-package", "1.0"), "", nil))
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Contains(t, body, "Upload payload does not have a file")
+	})
+
+	t.Run("invalid filename", func(t *testing.T) {
+		status, body := doRequest(t, newUploadRequest(t, server.URL+"/legacy/", twineFields("my-package", "1.0"), "my_package-1.0.txt", []byte("sdist")))
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Contains(t, body, "Invalid distribution file")
+	})
+}
+
+func TestLegacyUploadVerifiesDigests(t *testing.T) {
+	server, storage := newUploadServer(t)
+	content := newDistribution(t, "my_package-1.0.tar.gz", "")
+	md5Digest := md5.Sum(content)
+	blake2Digest := blake2b.Sum256(content)
+
+	fields := twineFields("my-package", "1.0")
+	fields.Set("md5_digest", hex.EncodeToString(md5Digest[:]))
+	fields.Set("sha256_digest", pipy.CalculateSHA256(content))
+	fields.Set("blake2_256_digest", hex.EncodeToString(blake2Digest[:]))
+	status, body := doRequest(t, newUploadRequest(t, server.URL+"/legacy/", fields, "my_package-1.0.tar.gz", content))
+	assert.Equal(t, http.StatusOK, status, body)
+
+	for digest, length := range map[string]int{"md5_digest": 32, "sha256_digest": 64, "blake2_256_digest": 64} {
+		t.Run(digest, func(t *testing.T) {
+			fields := twineFields("my-package", "2.0")
+			fields.Set(digest, strings.Repeat("0", length))
+			status, body := doRequest(t, newUploadRequest(t, server.URL+"/legacy/", fields, "my_package-2.0.tar.gz", newDistribution(t, "my_package-2.0.tar.gz", "")))
+			assert.Equal(t, http.StatusBadRequest, status)
+			assert.Contains(t, body, "The "+digest+" supplied does not match")
+
+			_, err := storage.Stat("my-package/2.0/my_package-2.0.tar.gz")
+			assert.Equal(t, pipy.FileNotFound, err)
+			files, _ := storage.List("my-package/2.0")
+			assert.Empty(t, files)
+		})
+	}
+}
+
+func TestLegacyUploadNormalizesVersions(t *testing.T) {
+	server, storage := newUploadServer(t)
+
+	uploads := map[string]string{
+		"1.0":       "my_package-1.0.tar.gz",
+		"1.0.0":     "my_package-1.0.0-py3-none-any.whl",
+		"2.0-RC.1":  "my_package-2.0rc1.tar.gz",
+		"1.10":      "my_package-1.10.tar.gz",
+		"1.2.post0": "my_package-1.2.post0.tar.gz",
+	}
+	for _, version := range []string{"1.0", "1.0.0", "2.0-RC.1", "1.10", "1.2.post0"} {
+		req := newUploadRequest(t, server.URL+"/legacy/", twineFields("my-package", version), uploads[version], newDistribution(t, uploads[version], ""))
+		status, body := doRequest(t, req)
+		assert.Equal(t, http.StatusOK, status, body)
+	}
+
+	// 1.0.0 is the same release as 1.0
+	_, err := storage.Stat("my-package/1.0/my_package-1.0.0-py3-none-any.whl")
+	assert.NoError(t, err)
+	_, err = storage.Stat("my-package/2.0rc1/my_package-2.0rc1.tar.gz")
+	assert.NoError(t, err)
+
+	req, err := http.NewRequest("GET", server.URL+"/simple/my-package/", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Accept", "application/vnd.pypi.simple.v1+json")
+	status, body := doRequest(t, req)
+	assert.Equal(t, http.StatusOK, status, body)
+	var descriptor pipy.Response
+	assert.NoError(t, json.Unmarshal([]byte(body), &descriptor))
+	assert.Equal(t, []string{"1.0", "1.2.post0", "1.10", "2.0rc1"}, descriptor.Versions)
+}
+
+func newWheel(t *testing.T, distInfo string, metadata string) []byte {
+	buffer := &bytes.Buffer{}
+	writer := zip.NewWriter(buffer)
+	file, err := writer.Create(distInfo + "/METADATA")
+	assert.NoError(t, err)
+	_, err = file.Write([]byte(metadata))
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	return buffer.Bytes()
+}
+
+func newSdist(t *testing.T, dir string, pkgInfo string) []byte {
+	buffer := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(buffer)
+	writer := tar.NewWriter(gzipWriter)
+	assert.NoError(t, writer.WriteHeader(&tar.Header{Name: dir + "/PKG-INFO", Mode: 0644, Size: int64(len(pkgInfo)), Typeflag: tar.TypeReg}))
+	_, err := writer.Write([]byte(pkgInfo))
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	assert.NoError(t, gzipWriter.Close())
+	return buffer.Bytes()
+}
+
+// Builds a valid distribution for the filename, with the description in its metadata so
+// distributions of the same file can differ
+func newDistribution(t *testing.T, filename string, description string) []byte {
+	distribution, err := pipy.ParseDistributionFilename(filename)
+	assert.NoError(t, err)
+	dir := distribution.Name + "-" + distribution.Version
+	metadata := "Metadata-Version: 2.1\nName: " + distribution.Name + "\nVersion: " + distribution.Version + "\n\n" + description + "\n"
+	switch {
+	case strings.HasSuffix(filename, ".whl"):
+		return newWheel(t, dir+".dist-info", metadata)
+	case strings.HasSuffix(filename, ".zip"):
+		buffer := &bytes.Buffer{}
+		writer := zip.NewWriter(buffer)
+		file, err := writer.Create(dir + "/PKG-INFO")
+		assert.NoError(t, err)
+		_, err = file.Write([]byte(metadata))
+		assert.NoError(t, err)
+		assert.NoError(t, writer.Close())
+		return buffer.Bytes()
+	}
+	return newSdist(t, dir, metadata)
+}
+
+func TestLegacyUploadChecksDistribution(t *testing.T) {
+	server, storage := newUploadServer(t)
+	metadata := func(name string, version string) string {
+		return "Metadata-Version: 2.1\nName: " + name + "\nVersion: " + version + "\n\nLong description\n"
+	}
+
+	valid := map[string][]byte{
+		"My.Package-1.0.0-py3-none-any.whl": newWheel(t, "My.Package-1.0.0.dist-info", metadata("My.Package", "1.0.0")),
+		"my_package-1.0.tar.gz":             newSdist(t, "my_package-1.0", metadata("my_package", "1.0")),
+	}
+	for filename, content := range valid {
+		t.Run(filename, func(t *testing.T) {
+			status, body := doRequest(t, newUploadRequest(t, server.URL+"/legacy/", twineFields("my-package", "1.0"), filename, content))
+			assert.Equal(t, http.StatusOK, status, body)
+		})
+	}
+
+	invalid := map[string]struct {
+		filename string
+		content  []byte
+		message  string
+	}{
+		"filename name": {"other_package-1.0.tar.gz", []byte("sdist"), "Start filename for"},
+		"filename version": {"my_package-2.0-py3-none-any.whl", newWheel(t, "my_package-2.0.dist-info", metadata("my-package", "2.0")),
+			"Version in filename should be"},
+		"wheel metadata name": {"my_package-1.1-py3-none-any.whl", newWheel(t, "other-1.1.dist-info", metadata("other", "1.1")),
+			"The name in the metadata"},
+		"sdist metadata version": {"my_package-1.1.tar.gz", newSdist(t, "my_package-1.1", metadata("my-package", "2.0")),
+			"The version in the metadata"},
+		"unreadable wheel":       {"my_package-1.1-py3-none-any.whl", []byte("wheel"), "Invalid distribution file"},
+		"unreadable sdist":       {"my_package-1.1.tar.gz", []byte("sdist"), "Invalid distribution file"},
+		"sdist without PKG-INFO": {"my_package-1.1.tar.gz", newSdist(t, "my_package-1.1/src", metadata("my-package", "1.1")), "Invalid distribution file"},
+		"wheel without METADATA": {"my_package-1.1-py3-none-any.whl", newWheel(t, "my_package/data", metadata("my-package", "1.1")), "Invalid distribution file"},
+	}
+	for name, test := range invalid {
+		t.Run(name, func(t *testing.T) {
+			status, body := doRequest(t, newUploadRequest(t, server.URL+"/legacy/", twineFields("my-package", "1.1"), test.filename, test.content))
+			assert.Equal(t, http.StatusBadRequest, status)
+			assert.Contains(t, body, test.message)
+		})
+	}
+	_, err := storage.List("my-package/1.1")
+	assert.Equal(t, pipy.FileNotFound, err)
+}
+
+func TestLegacyUploadOverwritePolicy(t *testing.T) {
+	tests := []struct {
+		policy    pipy.OverwritePolicy
+		version   string
+		overwrite bool
+	}{
+		{"", "1.0", false},
+		{pipy.OverwriteImmutable, "1.0.dev1", false},
+		{pipy.OverwriteAllow, "1.0", true},
+		{pipy.OverwriteAllowDevVersions, "1.0", false},
+		{pipy.OverwriteAllowDevVersions, "1.0.dev1", true},
+	}
+	for _, test := range tests {
+		t.Run(string(test.policy)+" "+test.version, func(t *testing.T) {
+			server, storage := newUploadServerWithConfig(t, &PyPiConfig{OverwritePolicy: test.policy})
+			filename := "my_package-" + test.version + ".tar.gz"
+			upload := func(content string) (int, string) {
+				return doRequest(t, newUploadRequest(t, server.URL+"/legacy/", twineFields("my-package", test.version), filename, newDistribution(t, filename, content)))
+			}
+
+			status, body := upload("first")
+			assert.Equal(t, http.StatusOK, status, body)
+			// Uploading the same file again is a no-op, so retried uploads succeed
+			status, body = upload("first")
+			assert.Equal(t, http.StatusOK, status, body)
+
+			status, body = upload("second")
+			want := "first"
+			if test.overwrite {
+				assert.Equal(t, http.StatusOK, status, body)
+				want = "second"
+			} else {
+				assert.Equal(t, http.StatusConflict, status)
+				assert.Contains(t, body, "File already exists")
+			}
+			file, err := storage.Open("my-package/" + test.version + "/" + filename)
+			assert.NoError(t, err)
+			defer file.Close()
+			content, _ := io.ReadAll(file)
+			assert.Equal(t, newDistribution(t, filename, want), content)
+		})
+	}
+}
+
+// Storage taking a while to write, so concurrent writes overlap
+type slowStorage struct {
+	pipy.Storage
+}
+
+func (s slowStorage) Put(key string, r io.Reader) error {
+	time.Sleep(20 * time.Millisecond)
+	return s.Storage.Put(key, r)
+}
+
+func TestConcurrentUploadsOfTheSameFile(t *testing.T) {
+	storage := slowStorage{pipy.NewFileSystemStorage(t.TempDir())}
+	server := httptest.NewServer(NewPyPiMux(&PyPiConfig{
+		MaxFileSizeMB: 128,
+		Storage:       storage,
+		IndexPath:     filepath.Join(t.TempDir(), "index.db"),
+	}))
+	t.Cleanup(server.Close)
+	filename := "my_package-1.0.tar.gz"
+	var wg sync.WaitGroup
+	statuses := make([]int, 8)
+	for i := range statuses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses[i], _ = doRequest(t, newUploadRequest(t, server.URL+"/legacy/", twineFields("my-package", "1.0"), filename, newDistribution(t, filename, strconv.Itoa(i))))
+		}()
+	}
+	wg.Wait()
+
+	// Only one of the different files is stored, the others conflict with it
+	stored := -1
+	for i, status := range statuses {
+		if status == http.StatusOK {
+			assert.Equal(t, -1, stored, "more than one upload succeeded")
+			stored = i
+		} else {
+			assert.Equal(t, http.StatusConflict, status)
+		}
+	}
+	file, err := storage.Open("my-package/1.0/" + filename)
+	assert.NoError(t, err)
+	defer file.Close()
+	content, _ := io.ReadAll(file)
+	assert.Equal(t, newDistribution(t, filename, strconv.Itoa(stored)), content)
+}
+
+func TestLegacyUploadKeepsPerFileMetadata(t *testing.T) {
+	server, storage := newUploadServer(t)
+
+	wheelFields := twineFields("my-package", "1.0")
+	wheelFields.Set("filetype", "bdist_wheel")
+	wheelFields.Set("pyversion", "py3")
+	wheelFields.Set("requires_python", ">=3.8")
+	wheel := newDistribution(t, "my_package-1.0-py3-none-any.whl", "")
+	req := newUploadRequest(t, server.URL+"/legacy/", wheelFields, "my_package-1.0-py3-none-any.whl", wheel)
+	req.SetBasicAuth("__token__", "pypi-token")
+	status, body := doRequest(t, req)
+	assert.Equal(t, http.StatusOK, status, body)
+
+	sdistFields := twineFields("my-package", "1.0")
+	sdistFields.Set("requires_python", ">=3.9")
+	sdistFields.Set("summary", "An updated summary")
+	sdistFields.Del("license")
+	sdistFields.Del("classifiers")
+	sdistFields.Del("requires_dist")
+	status, body = doRequest(t, newUploadRequest(t, server.URL+"/legacy/", sdistFields, "my_package-1.0.tar.gz", newDistribution(t, "my_package-1.0.tar.gz", "")))
+	assert.Equal(t, http.StatusOK, status, body)
+
+	req, err := http.NewRequest("GET", server.URL+"/simple/my-package/", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Accept", "application/vnd.pypi.simple.v1+json")
+	status, body = doRequest(t, req)
+	assert.Equal(t, http.StatusOK, status, body)
+	var descriptor pipy.Response
+	assert.NoError(t, json.Unmarshal([]byte(body), &descriptor))
+	requiresPython := map[string]string{}
+	for _, file := range descriptor.Files {
+		requiresPython[file.Filename] = *file.RequiresPython
+	}
+	assert.Equal(t, map[string]string{"my_package-1.0-py3-none-any.whl": ">=3.8", "my_package-1.0.tar.gz": ">=3.9"}, requiresPython)
+
+	recordFile, err := storage.Open("my-package/1.0/.files/my_package-1.0-py3-none-any.whl.json")
+	assert.NoError(t, err)
+	defer recordFile.Close()
+	var record pipy.FileRecord
+	assert.NoError(t, json.NewDecoder(recordFile).Decode(&record))
+	assert.Equal(t, "bdist_wheel", record.FileType)
+	assert.Equal(t, "py3", record.PyVersion)
+	assert.Equal(t, "__token__", record.Uploader)
+	assert.Equal(t, pipy.CalculateSHA256(wheel), record.Hashes.SHA256)
+
+	requestFile, err := storage.Open("my-package/1.0/request.json")
+	assert.NoError(t, err)
+	defer requestFile.Close()
+	var release pipy.UploadRequestForm
+	assert.NoError(t, json.NewDecoder(requestFile).Decode(&release))
+	assert.Equal(t, "An updated summary", release.Summary)
+	assert.Equal(t, "MIT", release.License)
+	assert.Equal(t, []string{"Programming Language :: Python :: 3", "License :: OSI Approved :: MIT License"}, release.Classifiers)
+	assert.Equal(t, []string{"requests>=2", "click"}, release.RequiresDist)
+	assert.Empty(t, release.FileType)
+	assert.Empty(t, release.Sha256Digest)
+}
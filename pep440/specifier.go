@@ -0,0 +1,194 @@
+package pep440
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Specifier is a single version clause, e.g. ">=1.2" or "==2.*"
+type Specifier struct {
+	Operator string
+	Version  string
+	wildcard bool
+	parsed   *Version
+}
+
+// SpecifierSet is a comma separated list of clauses, all of which must match
+type SpecifierSet []Specifier
+
+var specifierRegex = regexp.MustCompile(`^\s*(~=|===|==|!=|<=|>=|<|>)\s*([^\s,;]+)\s*$`)
+
+// Parses a specifier set such as ">=1.2,<2" or "~=3.8". An empty string matches every version.
+func ParseSpecifiers(specifiers string) (SpecifierSet, error) {
+	set := SpecifierSet{}
+	if strings.TrimSpace(specifiers) == "" {
+		return set, nil
+	}
+	for _, clause := range strings.Split(specifiers, ",") {
+		specifier, err := ParseSpecifier(clause)
+		if err != nil {
+			return nil, err
+		}
+		set = append(set, *specifier)
+	}
+	return set, nil
+}
+
+func ParseSpecifier(clause string) (*Specifier, error) {
+	match := specifierRegex.FindStringSubmatch(clause)
+	if match == nil {
+		return nil, fmt.Errorf("invalid specifier: %q", clause)
+	}
+	specifier := &Specifier{Operator: match[1], Version: match[2]}
+	if specifier.Operator == "===" {
+		return specifier, nil
+	}
+	version := specifier.Version
+	if strings.HasSuffix(version, ".*") {
+		if specifier.Operator != "==" && specifier.Operator != "!=" {
+			return nil, fmt.Errorf("invalid specifier: %q, only == and != accept a wildcard", clause)
+		}
+		specifier.wildcard = true
+		version = strings.TrimSuffix(version, ".*")
+	}
+	parsed, err := Parse(version)
+	if err != nil {
+		return nil, fmt.Errorf("invalid specifier: %q: %v", clause, err)
+	}
+	if len(parsed.Local) > 0 && (specifier.wildcard || (specifier.Operator != "==" && specifier.Operator != "!=")) {
+		return nil, fmt.Errorf("invalid specifier: %q, local versions are only allowed with == and !=", clause)
+	}
+	if specifier.wildcard && parsed.Dev != nil {
+		return nil, fmt.Errorf("invalid specifier: %q, a wildcard cannot follow a dev release", clause)
+	}
+	if specifier.Operator == "~=" && len(parsed.Release) < 2 {
+		return nil, fmt.Errorf("invalid specifier: %q, ~= needs at least two release segments", clause)
+	}
+	specifier.parsed = parsed
+	return specifier, nil
+}
+
+func (s Specifier) String() string {
+	return s.Operator + s.Version
+}
+
+// Reports whether the version satisfies the specifier
+func (s Specifier) Contains(version *Version) bool {
+	switch s.Operator {
+	case "===":
+		return strings.EqualFold(version.String(), s.Version)
+	case "==":
+		if s.wildcard {
+			return prefixMatch(version, s.parsed)
+		}
+		candidate := version
+		if len(s.parsed.Local) == 0 {
+			candidate = version.Public()
+		}
+		return candidate.Compare(s.parsed) == 0
+	case "!=":
+		return !Specifier{Operator: "==", Version: s.Version, wildcard: s.wildcard, parsed: s.parsed}.Contains(version)
+	case "~=":
+		prefix := *s.parsed
+		prefix.Release = prefix.Release[:len(prefix.Release)-1]
+		prefix.PreLabel, prefix.Pre, prefix.Post, prefix.Dev = "", 0, nil, nil
+		return version.Public().Compare(s.parsed) >= 0 && prefixMatch(version, &prefix)
+	case "<=":
+		return version.Public().Compare(s.parsed) <= 0
+	case ">=":
+		return version.Public().Compare(s.parsed) >= 0
+	case "<":
+		if version.Public().Compare(s.parsed) >= 0 {
+			return false
+		}
+		// <V excludes the pre-releases of V unless V is itself a pre-release
+		if !s.parsed.IsPrerelease() && version.IsPrerelease() && version.BaseVersion().Compare(s.parsed.BaseVersion()) == 0 {
+			return false
+		}
+		return true
+	case ">":
+		if version.Public().Compare(s.parsed) <= 0 {
+			return false
+		}
+		// >V excludes the post-releases of V unless V is itself a post-release
+		if s.parsed.Post == nil && version.Post != nil && version.BaseVersion().Compare(s.parsed.BaseVersion()) == 0 {
+			return false
+		}
+		// and the local versions of V
+		if len(version.Local) > 0 && version.Public().Compare(s.parsed) == 0 {
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// Reports whether the version satisfies every specifier. Pre-releases only match if allowed
+// or if one of the specifiers explicitly names a pre-release.
+func (set SpecifierSet) Contains(version *Version, prereleases bool) bool {
+	if version.IsPrerelease() && !prereleases {
+		named := false
+		for _, specifier := range set {
+			if specifier.parsed != nil && specifier.parsed.IsPrerelease() {
+				named = true
+			}
+		}
+		if !named {
+			return false
+		}
+	}
+	for _, specifier := range set {
+		if !specifier.Contains(version) {
+			return false
+		}
+	}
+	return true
+}
+
+func (set SpecifierSet) String() string {
+	clauses := make([]string, len(set))
+	for i, specifier := range set {
+		clauses[i] = specifier.String()
+	}
+	return strings.Join(clauses, ",")
+}
+
+// Splits a version into the components compared by prefix matching, e.g. 1!2.0rc1 is
+// ["1", "2", "0", "rc1"]
+func versionComponents(v *Version) []string {
+	components := []string{strconv.Itoa(v.Epoch)}
+	for _, n := range v.Release {
+		components = append(components, strconv.Itoa(n))
+	}
+	if v.PreLabel != "" {
+		components = append(components, v.PreLabel+strconv.Itoa(v.Pre))
+	}
+	if v.Post != nil {
+		components = append(components, "post"+strconv.Itoa(*v.Post))
+	}
+	if v.Dev != nil {
+		components = append(components, "dev"+strconv.Itoa(*v.Dev))
+	}
+	return components
+}
+
+// Reports whether the public version starts with the prefix, padding the release with zeros
+func prefixMatch(version *Version, prefix *Version) bool {
+	candidate := *version.Public()
+	if len(candidate.Release) < len(prefix.Release) {
+		candidate.Release = append(append([]int{}, candidate.Release...), make([]int, len(prefix.Release)-len(candidate.Release))...)
+	}
+	candidateComponents := versionComponents(&candidate)
+	prefixComponents := versionComponents(prefix)
+	if len(candidateComponents) < len(prefixComponents) {
+		return false
+	}
+	for i, component := range prefixComponents {
+		if candidateComponents[i] != component {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package pep440
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpecifierSetContains(t *testing.T) {
+	tests := []struct {
+		specifiers string
+		version    string
+		want       bool
+	}{
+		{">=1.2,<2", "1.2", true},
+		{">=1.2,<2", "1.9.9", true},
+		{">=1.2,<2", "2.0", false},
+		{">=1.2,<2", "1.1", false},
+		{"==1.0", "1.0.0", true},
+		{"==1.0", "1.0+local", true},
+		{"==1.0+local", "1.0", false},
+		{"==1.0+local", "1.0+local", true},
+		{"==1.*", "1.5.2", true},
+		{"==1.*", "10.0", false},
+		{"==1.0.*", "1", true},
+		{"!=1.0.*", "1.0.5", false},
+		{"!=1.0.*", "1.1", true},
+		{"~=2.2", "2.3", true},
+		{"~=2.2", "3.0", false},
+		{"~=2.2", "2.1", false},
+		{"~=1.4.5", "1.4.9", true},
+		{"~=1.4.5", "1.5.0", false},
+		{"<2.0", "2.0rc1", false},
+		{"<2.0rc2", "2.0rc1", true},
+		{">1.7", "1.7.post1", false},
+		{">1.7.post1", "1.7.post2", true},
+		{">1.7", "1.7+local", false},
+		{">1.7", "1.7.1", true},
+		{"<=1.7", "1.7+local", true},
+		{"===1.0.0", "1.0.0", true},
+		{"===1.0.0", "1.0", false},
+		{"", "3.1", true},
+	}
+	for _, test := range tests {
+		t.Run(test.specifiers+" "+test.version, func(t *testing.T) {
+			set, err := ParseSpecifiers(test.specifiers)
+			assert.NoError(t, err)
+			version, err := Parse(test.version)
+			assert.NoError(t, err)
+			assert.Equal(t, test.want, set.Contains(version, true))
+		})
+	}
+}
+
+func TestSpecifierSetPrereleases(t *testing.T) {
+	set, _ := ParseSpecifiers(">=1.0")
+	prerelease, _ := Parse("2.0b1")
+	assert.False(t, set.Contains(prerelease, false))
+	assert.True(t, set.Contains(prerelease, true))
+
+	set, _ = ParseSpecifiers(">=2.0a1")
+	assert.True(t, set.Contains(prerelease, false))
+}
+
+func TestParseSpecifiersInvalid(t *testing.T) {
+	for _, specifiers := range []string{"1.0", ">=", "~=1", ">=1.0.*", ">=1.0+local", "==1.0.dev1.*", ">=1.0,,<2", "=>1.0"} {
+		t.Run(specifiers, func(t *testing.T) {
+			_, err := ParseSpecifiers(specifiers)
+			assert.Error(t, err)
+		})
+	}
+}
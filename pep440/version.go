@@ -0,0 +1,282 @@
+// Package pep440 parses, normalizes and compares Python package versions (PEP 440)
+package pep440
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Version is a parsed PEP 440 version
+type Version struct {
+	Epoch   int
+	Release []int
+	// Pre-release phase ("a", "b" or "rc") and number
+	PreLabel string
+	Pre      int
+	Post     *int
+	Dev      *int
+	// Local version label segments, e.g. ["ubuntu", "1"]
+	Local []string
+}
+
+// Canonical PEP 440 regex, from the specification appendix
+var versionRegex = regexp.MustCompile(`(?i)^v?` +
+	`(?:(?P<epoch>[0-9]+)!)?` +
+	`(?P<release>[0-9]+(?:\.[0-9]+)*)` +
+	`(?P<pre>[-_.]?(?P<pre_l>alpha|a|beta|b|preview|pre|c|rc)[-_.]?(?P<pre_n>[0-9]+)?)?` +
+	`(?P<post>(?:-(?P<post_n1>[0-9]+))|(?:[-_.]?(?P<post_l>post|rev|r)[-_.]?(?P<post_n2>[0-9]+)?))?` +
+	`(?P<dev>[-_.]?(?P<dev_l>dev)[-_.]?(?P<dev_n>[0-9]+)?)?` +
+	`(?:\+(?P<local>[a-z0-9]+(?:[-_.][a-z0-9]+)*))?$`)
+
+var preLabels = map[string]string{
+	"a": "a", "alpha": "a",
+	"b": "b", "beta": "b",
+	"c": "rc", "rc": "rc", "pre": "rc", "preview": "rc",
+}
+
+var localSeparatorRegex = regexp.MustCompile(`[-_.]`)
+
+// Parses a version, accepting every form PEP 440 allows to normalize
+func Parse(version string) (*Version, error) {
+	match := versionRegex.FindStringSubmatch(strings.TrimSpace(version))
+	if match == nil {
+		return nil, fmt.Errorf("invalid version: %q", version)
+	}
+	group := func(name string) string {
+		return match[versionRegex.SubexpIndex(name)]
+	}
+	number := func(value string) (int, error) {
+		if value == "" {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid version: %q: %v", version, err)
+		}
+		return n, nil
+	}
+
+	v := &Version{}
+	var err error
+	if v.Epoch, err = number(group("epoch")); err != nil {
+		return nil, err
+	}
+	for _, part := range strings.Split(group("release"), ".") {
+		n, err := number(part)
+		if err != nil {
+			return nil, err
+		}
+		v.Release = append(v.Release, n)
+	}
+	if label := group("pre_l"); label != "" {
+		v.PreLabel = preLabels[strings.ToLower(label)]
+		if v.Pre, err = number(group("pre_n")); err != nil {
+			return nil, err
+		}
+	}
+	if group("post") != "" {
+		post, err := number(group("post_n1") + group("post_n2"))
+		if err != nil {
+			return nil, err
+		}
+		v.Post = &post
+	}
+	if group("dev") != "" {
+		dev, err := number(group("dev_n"))
+		if err != nil {
+			return nil, err
+		}
+		v.Dev = &dev
+	}
+	if local := group("local"); local != "" {
+		v.Local = localSeparatorRegex.Split(strings.ToLower(local), -1)
+	}
+	return v, nil
+}
+
+// Returns the normalized form of the version
+func (v *Version) String() string {
+	var builder strings.Builder
+	if v.Epoch != 0 {
+		fmt.Fprintf(&builder, "%d!", v.Epoch)
+	}
+	builder.WriteString(v.releaseString())
+	if v.PreLabel != "" {
+		fmt.Fprintf(&builder, "%s%d", v.PreLabel, v.Pre)
+	}
+	if v.Post != nil {
+		fmt.Fprintf(&builder, ".post%d", *v.Post)
+	}
+	if v.Dev != nil {
+		fmt.Fprintf(&builder, ".dev%d", *v.Dev)
+	}
+	if len(v.Local) > 0 {
+		builder.WriteString("+" + strings.Join(v.Local, "."))
+	}
+	return builder.String()
+}
+
+// Normalizes a version string, e.g. "1.0-RC.1" is "1.0rc1"
+func Normalize(version string) (string, error) {
+	v, err := Parse(version)
+	if err != nil {
+		return "", err
+	}
+	return v.String(), nil
+}
+
+// Reports whether the version is a pre-release or a development release
+func (v *Version) IsPrerelease() bool {
+	return v.PreLabel != "" || v.Dev != nil
+}
+
+// Returns the version without its local label
+func (v *Version) Public() *Version {
+	public := *v
+	public.Local = nil
+	return &public
+}
+
+// Returns the epoch and release segments of the version, e.g. 1.0 for 1.0rc1.post2+local
+func (v *Version) BaseVersion() *Version {
+	return &Version{Epoch: v.Epoch, Release: v.Release}
+}
+
+func (v *Version) releaseString() string {
+	parts := make([]string, len(v.Release))
+	for i, n := range v.Release {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ".")
+}
+
+// Compares two versions, returning -1, 0 or 1
+func (v *Version) Compare(other *Version) int {
+	if c := compareInt(v.Epoch, other.Epoch); c != 0 {
+		return c
+	}
+	if c := compareRelease(v.Release, other.Release); c != 0 {
+		return c
+	}
+	if c := compareInt(v.preKey(), other.preKey()); c != 0 {
+		return c
+	}
+	if v.PreLabel != "" && v.PreLabel == other.PreLabel {
+		if c := compareInt(v.Pre, other.Pre); c != 0 {
+			return c
+		}
+	}
+	if c := compareOptional(v.Post, other.Post, -1); c != 0 {
+		return c
+	}
+	if c := compareOptional(v.Dev, other.Dev, 1); c != 0 {
+		return c
+	}
+	return compareLocal(v.Local, other.Local)
+}
+
+// Orders the pre-release phase: dev-only releases sort before pre-releases, which sort
+// before final releases
+func (v *Version) preKey() int {
+	switch {
+	case v.PreLabel == "" && v.Post == nil && v.Dev != nil:
+		return -1
+	case v.PreLabel == "a":
+		return 0
+	case v.PreLabel == "b":
+		return 1
+	case v.PreLabel == "rc":
+		return 2
+	}
+	return 3
+}
+
+func compareInt(a int, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// Compares release segments, ignoring trailing zeros so 1.0 == 1.0.0
+func compareRelease(a []int, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if c := compareInt(x, y); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// Compares optional numbers, a missing number sorts as missing (-1 or 1) would
+func compareOptional(a *int, b *int, missing int) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return missing
+	case b == nil:
+		return -missing
+	}
+	return compareInt(*a, *b)
+}
+
+// Compares local labels: numeric segments sort after alphanumeric ones, and a label sorts
+// after its prefixes
+func compareLocal(a []string, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		x, xErr := strconv.Atoi(a[i])
+		y, yErr := strconv.Atoi(b[i])
+		switch {
+		case xErr == nil && yErr == nil:
+			if c := compareInt(x, y); c != 0 {
+				return c
+			}
+		case xErr == nil:
+			return 1
+		case yErr == nil:
+			return -1
+		default:
+			if c := strings.Compare(a[i], b[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return compareInt(len(a), len(b))
+}
+
+// Compares two version strings. Invalid versions sort before valid ones, and among
+// themselves lexicographically.
+func Compare(a string, b string) int {
+	va, errA := Parse(a)
+	vb, errB := Parse(b)
+	switch {
+	case errA != nil && errB != nil:
+		return strings.Compare(a, b)
+	case errA != nil:
+		return -1
+	case errB != nil:
+		return 1
+	}
+	return va.Compare(vb)
+}
+
+// Sorts version strings in ascending PEP 440 order
+func Sort(versions []string) {
+	sort.SliceStable(versions, func(i, j int) bool {
+		return Compare(versions[i], versions[j]) < 0
+	})
+}
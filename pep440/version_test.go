@@ -0,0 +1,92 @@
+package pep440
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNormalizes(t *testing.T) {
+	tests := map[string]string{
+		"1.0":                "1.0",
+		"v1.0":               "1.0",
+		"01.02.003":          "1.2.3",
+		"1!2.0":              "1!2.0",
+		"1.0a1":              "1.0a1",
+		"1.0-alpha.1":        "1.0a1",
+		"1.0.beta2":          "1.0b2",
+		"1.0c1":              "1.0rc1",
+		"1.0-preview-3":      "1.0rc3",
+		"1.0RC":              "1.0rc0",
+		"1.0-1":              "1.0.post1",
+		"1.0.post":           "1.0.post0",
+		"1.0-r4":             "1.0.post4",
+		"1.0rev2":            "1.0.post2",
+		"1.0.dev":            "1.0.dev0",
+		"1.0-dev-5":          "1.0.dev5",
+		"1.0a1.post2.dev3":   "1.0a1.post2.dev3",
+		"1.0+Ubuntu-1":       "1.0+ubuntu.1",
+		"1.0+local_version":  "1.0+local.version",
+		"  2.3.4  ":          "2.3.4",
+		"2025.10.1.post0+gh": "2025.10.1.post0+gh",
+	}
+	for input, want := range tests {
+		t.Run(input, func(t *testing.T) {
+			version, err := Parse(input)
+			assert.NoError(t, err)
+			assert.Equal(t, want, version.String())
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, input := range []string{"", "latest", "1.0-beta-gamma", "1..0", "1.0+", "1.0+local!", "french toast"} {
+		t.Run(input, func(t *testing.T) {
+			_, err := Parse(input)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestSort(t *testing.T) {
+	// Ordering from the PEP 440 specification, plus epochs and local versions
+	ordered := []string{
+		"1.0.dev456",
+		"1.0a1",
+		"1.0a2.dev456",
+		"1.0a12.dev456",
+		"1.0a12",
+		"1.0b1.dev456",
+		"1.0b2",
+		"1.0b2.post345.dev456",
+		"1.0b2.post345",
+		"1.0rc1.dev456",
+		"1.0rc1",
+		"1.0",
+		"1.0+abc.5",
+		"1.0+abc.7",
+		"1.0+5",
+		"1.0.post456.dev34",
+		"1.0.post456",
+		"1.0.15",
+		"1.1.dev1",
+		"2.0",
+		"10.0",
+		"1!0.1",
+	}
+	shuffled := append([]string{}, ordered...)
+	rand.New(rand.NewSource(1)).Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	Sort(shuffled)
+	assert.Equal(t, ordered, shuffled)
+}
+
+func TestCompare(t *testing.T) {
+	assert.Equal(t, 0, Compare("1.0", "1.0.0"))
+	assert.Equal(t, 0, Compare("1.0.post0", "1.0-0"))
+	assert.Equal(t, -1, Compare("1.0", "1.0.post0"))
+	assert.Equal(t, -1, Compare("not a version", "0.1"))
+	assert.Equal(t, 1, Compare("0.1", "not a version"))
+}
@@ -0,0 +1,157 @@
+package pipy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Simple page of a project from an upstream, with the validators to revalidate it
+type CachedDescriptor struct {
+	Response     *Response `json:"response"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last-modified,omitempty"`
+	FetchedAt    time.Time `json:"fetched-at"`
+}
+
+var defaultDescriptorCacheTTL = 10 * time.Minute
+var defaultDescriptorStaleTTL = 24 * time.Hour
+
+// How long cached upstream descriptors are served without asking the upstream
+var descriptorCacheTTL = defaultDescriptorCacheTTL
+
+// How long expired descriptors are still served while they are revalidated in the background
+var descriptorStaleTTL = defaultDescriptorStaleTTL
+
+// Descriptors being revalidated in the background, so each is only fetched once at a time
+var revalidating sync.Map
+
+// Sets how long upstream descriptors are cached, and for how long after that they are
+// served stale while revalidated. Nil uses the defaults, 10 minutes and 24 hours, while zero
+// revalidates them on every request or never serves them stale.
+func SetupDescriptorCache(ttl *time.Duration, staleWhileRevalidate *time.Duration) error {
+	cacheTTL, staleTTL := defaultDescriptorCacheTTL, defaultDescriptorStaleTTL
+	if ttl != nil {
+		cacheTTL = *ttl
+	}
+	if staleWhileRevalidate != nil {
+		staleTTL = *staleWhileRevalidate
+	}
+	if cacheTTL < 0 || staleTTL < 0 {
+		return newError("descriptor cache durations can't be negative")
+	}
+	descriptorCacheTTL, descriptorStaleTTL = cacheTTL, staleTTL
+	return nil
+}
+
+// Gets the descriptor of a project from the cache. It is revalidated with the upstream once
+// older than the TTL, in the background while it may still be served stale. If the upstream
+// can't be reached, or in offline mode, the cached descriptor is served marked as stale.
+func (u *Upstream) getDescriptor(project string) (*Response, error) {
+	cached, err := index.GetDescriptor(u.Name, project)
+	if err != nil && err != FileNotFound {
+		Logger.Warn("Ignoring cached descriptor", "upstream", u.Name, "project", project, "error", err)
+	}
+	if cached == nil {
+		return u.fetchDescriptorOnce(project, nil)
+	}
+	if offline {
+		cached.Response.Stale = true
+		return cached.Response, nil
+	}
+	age := time.Since(cached.FetchedAt)
+	if age < descriptorCacheTTL {
+		return cached.Response, nil
+	}
+	if age < descriptorCacheTTL+descriptorStaleTTL {
+		u.revalidateInBackground(project, cached)
+		return cached.Response, nil
+	}
+	response, err := u.fetchDescriptorOnce(project, cached)
+	if err != nil && err != RepoNotFound {
+		// Failing open, an outdated descriptor is better than none
+		Logger.Warn("Serving stale descriptor of unreachable upstream", "upstream", u.Name, "project", project, "error", err)
+		cached.Response.Stale = true
+		return cached.Response, nil
+	}
+	return response, err
+}
+
+func (u *Upstream) revalidateInBackground(project string, cached *CachedDescriptor) {
+	key := u.Name + "/" + NormalizeProjectName(project)
+	if _, running := revalidating.LoadOrStore(key, true); running {
+		return
+	}
+	go func() {
+		defer revalidating.Delete(key)
+		if _, err := u.fetchDescriptor(project, cached); err != nil && err != RepoNotFound {
+			Logger.Warn("Failed to revalidate descriptor", "upstream", u.Name, "project", project, "error", err)
+		}
+	}()
+}
+
+// Fetches the descriptor like fetchDescriptor, sharing the request with concurrent requesters
+func (u *Upstream) fetchDescriptorOnce(project string, cached *CachedDescriptor) (*Response, error) {
+	key := string(descriptorsBucket) + "/" + string(descriptorKey(u.Name, project))
+	response, err, _ := fetches.Do(key, func() (any, error) {
+		return u.fetchDescriptor(project, cached)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return response.(*Response), nil
+}
+
+// Gets the descriptor from the upstream and caches it. A cached descriptor is revalidated
+// with its ETag and Last-Modified, and kept if the upstream answers 304. Projects the
+// upstream answers a 404 for aren't found, and other answers than a 200 fail.
+func (u *Upstream) fetchDescriptor(project string, cached *CachedDescriptor) (*Response, error) {
+	header := http.Header{}
+	if cached != nil && cached.ETag != "" {
+		header.Set("If-None-Match", cached.ETag)
+	}
+	if cached != nil && cached.LastModified != "" {
+		header.Set("If-Modified-Since", cached.LastModified)
+	}
+	what := "the simple page of " + project
+	response, err := u.get(u.projectUrl(project), "application/vnd.pypi.simple.v1+json", header)
+	if err != nil {
+		return nil, u.requestError(what, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotModified && cached != nil {
+		Logger.Debug("Cached descriptor is still valid", "upstream", u.Name, "project", project)
+		cached.FetchedAt = time.Now().UTC()
+		if err := index.PutDescriptor(u.Name, project, cached); err != nil {
+			Logger.Warn("Failed to cache descriptor", "upstream", u.Name, "project", project, "error", err)
+		}
+		return cached.Response, nil
+	}
+	if response.StatusCode == http.StatusNotFound {
+		if cached != nil {
+			if err := index.DeleteDescriptor(u.Name, project); err != nil {
+				Logger.Warn("Failed to delete cached descriptor", "upstream", u.Name, "project", project, "error", err)
+			}
+		}
+		return nil, RepoNotFound
+	}
+	if err := u.responseError(what, response); err != nil {
+		return nil, err
+	}
+
+	responseData, err := u.readDescriptor(project, response)
+	if err != nil {
+		return nil, err
+	}
+	fetched := &CachedDescriptor{
+		Response:     responseData,
+		ETag:         response.Header.Get("ETag"),
+		LastModified: response.Header.Get("Last-Modified"),
+		FetchedAt:    time.Now().UTC(),
+	}
+	if err := index.PutDescriptor(u.Name, project, fetched); err != nil {
+		Logger.Warn("Failed to cache descriptor", "upstream", u.Name, "project", project, "error", err)
+	}
+	return responseData, nil
+}
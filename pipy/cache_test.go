@@ -0,0 +1,112 @@
+package pipy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDescriptorCacheRevalidates(t *testing.T) {
+	useTestStorage(t)
+	var requests, notModified atomic.Int32
+	var filename atomic.Value
+	filename.Store("numpy-2.3.4.tar.gz")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		etag := `"` + filename.Load().(string) + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		json.NewEncoder(w).Encode(Response{Name: "numpy", Files: []File{{Filename: filename.Load().(string), URL: "numpy.tar.gz"}}})
+	}))
+	defer server.Close()
+
+	previousUpstreams := upstreams
+	assert.NoError(t, SetupUpstreams([]UpstreamConfig{{Name: "pypi", URL: server.URL}}))
+	hour := time.Hour
+	assert.NoError(t, SetupDescriptorCache(&hour, &hour))
+	t.Cleanup(func() {
+		upstreams = previousUpstreams
+		SetupDescriptorCache(nil, nil)
+	})
+	age := func(age time.Duration) {
+		cached, err := index.GetDescriptor("pypi", "numpy")
+		assert.NoError(t, err)
+		cached.FetchedAt = time.Now().Add(-age)
+		assert.NoError(t, index.PutDescriptor("pypi", "numpy", cached))
+	}
+
+	for range 2 {
+		descriptor, err := GetProxyDescriptor("numpy")
+		assert.NoError(t, err)
+		assert.Equal(t, "numpy-2.3.4.tar.gz", descriptor.Files[0].Filename)
+	}
+	assert.Equal(t, int32(1), requests.Load())
+
+	// Expired descriptors are served while they are revalidated in the background
+	age(90 * time.Minute)
+	_, err := GetProxyDescriptor("numpy")
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return notModified.Load() == 1 }, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		cached, err := index.GetDescriptor("pypi", "numpy")
+		return err == nil && time.Since(cached.FetchedAt) < time.Minute
+	}, time.Second, 10*time.Millisecond)
+
+	// Past the stale window, the upstream is asked before answering
+	filename.Store("numpy-2.3.5.tar.gz")
+	age(3 * time.Hour)
+	descriptor, err := GetProxyDescriptor("numpy")
+	assert.NoError(t, err)
+	assert.Equal(t, "numpy-2.3.5.tar.gz", descriptor.Files[0].Filename)
+	assert.Equal(t, int32(3), requests.Load())
+}
+
+func TestDescriptorCacheOffline(t *testing.T) {
+	useTestStorage(t)
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		json.NewEncoder(w).Encode(Response{Name: "numpy", Files: []File{{Filename: "numpy-2.3.4.tar.gz", URL: "numpy.tar.gz"}}})
+	}))
+	defer server.Close()
+	previousUpstreams := upstreams
+	assert.NoError(t, SetupUpstreams([]UpstreamConfig{{Name: "pypi", URL: server.URL}}))
+	t.Cleanup(func() {
+		upstreams = previousUpstreams
+		SetupOfflineMode(false)
+	})
+
+	descriptor, err := GetProxyDescriptor("numpy")
+	assert.NoError(t, err)
+	assert.False(t, descriptor.Stale)
+
+	SetupOfflineMode(true)
+	descriptor, err = GetProxyDescriptor("numpy")
+	assert.NoError(t, err)
+	assert.True(t, descriptor.Stale)
+	assert.Equal(t, "numpy-2.3.4.tar.gz", descriptor.Files[0].Filename)
+	_, err = GetProxyDescriptor("scipy")
+	assert.Equal(t, UpstreamOffline, err)
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestSetupDescriptorCache(t *testing.T) {
+	t.Cleanup(func() { SetupDescriptorCache(nil, nil) })
+	zero, negative := time.Duration(0), -time.Second
+	assert.NoError(t, SetupDescriptorCache(&zero, &zero))
+	assert.Equal(t, time.Duration(0), descriptorCacheTTL)
+	assert.Equal(t, time.Duration(0), descriptorStaleTTL)
+	assert.NoError(t, SetupDescriptorCache(nil, nil))
+	assert.Equal(t, 10*time.Minute, descriptorCacheTTL)
+	assert.Equal(t, 24*time.Hour, descriptorStaleTTL)
+	assert.Error(t, SetupDescriptorCache(&negative, nil))
+}
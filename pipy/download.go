@@ -0,0 +1,299 @@
+package pipy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Download of a proxied file from its upstream, spooled to a temporary file. Requesters
+// stream the file while it is written, and it is committed to the storage once complete
+// and verified.
+type download struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	tmp  *os.File
+	// Content-Length of the upstream response, -1 if unknown
+	size    int64
+	written int64
+	// Digests of the downloaded content, checked again when it is committed
+	digests FileDigests
+	started bool
+	done    bool
+	err     error
+	// The requesters and the download itself, the temporary file is removed after the last
+	readers int
+}
+
+// Downloads in progress, by storage key
+var (
+	downloads   = map[string]*download{}
+	downloadsMu sync.Mutex
+)
+
+// Bytes of a download only streamed once it is verified
+var downloadHoldBack int64 = 32 * 1024
+
+// Other upstream requests in progress, by the storage key of their result, so concurrent
+// requesters share a single request
+var fetches singleflight.Group
+
+// Streams a reader of a download to a requester
+type downloadReader struct {
+	d      *download
+	offset int64
+}
+
+// Gets a reader of a proxied file that isn't stored yet, starting its download or attaching
+// to the one in progress. Returns FileNotFound if the file is stored. If the sha256 listed
+// by the upstream is given, a proxied file stored with another hash is deleted and downloaded
+// again, and a download with another hash fails with a 502. Uploaded files are never replaced.
+func openDownload(u *Upstream, fileUrl *url.URL, repoData *ProjectInfo, expectedSHA256 string) (*downloadReader, error) {
+	versionKey := packageVersionKey(repoData.Repo, repoData.Version)
+	key := path.Join(versionKey, repoData.Filename)
+	if reader := attachDownload(key); reader != nil {
+		return reader, nil
+	}
+	// The storage is checked under the lock of the key, so the requesters of other files
+	// don't wait for it, and a single requester of this one starts the download
+	unlock := lockKey(key)
+	defer unlock()
+	if reader := attachDownload(key); reader != nil {
+		return reader, nil
+	}
+	// Downloads leave the map once committed, so a stored file is complete
+	if _, err := storage.Stat(key); err == nil {
+		if expectedSHA256 == "" {
+			return nil, FileNotFound
+		}
+		record, err := getFileRecord(versionKey, repoData.Filename)
+		if err != nil {
+			return nil, err
+		}
+		if record.Upstream == "" || record.Hashes.SHA256 == expectedSHA256 {
+			return nil, FileNotFound
+		}
+		Logger.Warn("Deleting cached file with a hash not matching the upstream", "file", key, "sha256", record.Hashes.SHA256, "expected", expectedSHA256)
+		if err := deleteStoredFile(repoData.Repo, repoData.Version, repoData.Filename); err != nil {
+			return nil, err
+		}
+	}
+	tmp, err := os.CreateTemp("", tempFilePrefix+"download-*")
+	if err != nil {
+		return nil, newError("failed to create temporary file: %v", err)
+	}
+	d := &download{tmp: tmp, size: -1, readers: 1}
+	d.cond = sync.NewCond(&d.mu)
+	downloadsMu.Lock()
+	downloads[key] = d
+	downloadsMu.Unlock()
+	Logger.Debug("Downloading file from upstream", "upstream", u.Name, "url", fileUrl.String())
+	go func() {
+		err := d.fetch(u, fileUrl, expectedSHA256)
+		if err == nil {
+			record := &FileRecord{Filename: repoData.Filename, Upstream: u.Name}
+			// The upload time of the upstream, not of the download
+			if file := cachedUpstreamFile(u, repoData); file != nil && file.UploadTime != nil {
+				if uploadTime, err := time.Parse(time.RFC3339Nano, *file.UploadTime); err == nil {
+					record.UploadTime = uploadTime.UTC()
+				}
+			}
+			content := io.NewSectionReader(d.tmp, 0, d.written)
+			unlock := lockKey(key)
+			_, err = storeFileWithRecord(repoData.Repo, repoData.Version, record, content, FileDigests{SHA256: d.digests.SHA256})
+			unlock()
+		}
+		if err != nil {
+			Logger.Error("Failed to download file from upstream", "upstream", u.Name, "url", fileUrl.String(), "error", err)
+		}
+		downloadsMu.Lock()
+		delete(downloads, key)
+		downloadsMu.Unlock()
+		d.finish(err)
+		d.release()
+	}()
+	return d.attach(), nil
+}
+
+// Copies the upstream response to the temporary file, waking up the readers. Answers other
+// than a 200, and downloads that are cut short or don't match the expected sha256, if given,
+// fail.
+func (d *download) fetch(u *Upstream, fileUrl *url.URL, expectedSHA256 string) error {
+	filename := path.Base(fileUrl.Path)
+	response, err := u.get(fileUrl.String(), "", nil)
+	if err != nil {
+		return u.requestError(filename, err)
+	}
+	defer response.Body.Close()
+	// Failing before anything is streamed, so requesters get the status
+	if err := u.responseError(filename, response); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.size = response.ContentLength
+	d.started = true
+	d.cond.Broadcast()
+	d.mu.Unlock()
+
+	body := newDigestReader(response.Body, FileDigests{})
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buffer)
+		if n > 0 {
+			if _, err := d.tmp.Write(buffer[:n]); err != nil {
+				return newError("failed to write temporary file: %v", err)
+			}
+			d.mu.Lock()
+			d.written += int64(n)
+			d.cond.Broadcast()
+			d.mu.Unlock()
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return u.requestError(filename, err)
+		}
+	}
+	if d.size >= 0 && d.written != d.size {
+		return &Error{
+			Message: fmt.Sprintf("The download of %s is truncated, got %d of %d bytes.", filename, d.written, d.size),
+			Code:    http.StatusBadGateway,
+		}
+	}
+	d.digests = body.Digests()
+	if expectedSHA256 != "" && d.digests.SHA256 != expectedSHA256 {
+		return &Error{
+			Message: fmt.Sprintf("The sha256 of the downloaded %s is %s, the upstream lists %s.", filename, d.digests.SHA256, expectedSHA256),
+			Code:    http.StatusBadGateway,
+		}
+	}
+	return nil
+}
+
+// Attaches to the download of a key in progress, nil if there is none
+func attachDownload(key string) *downloadReader {
+	downloadsMu.Lock()
+	defer downloadsMu.Unlock()
+	if d, ok := downloads[key]; ok {
+		return d.attach()
+	}
+	return nil
+}
+
+func (d *download) finish(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.done = true
+	d.err = err
+	d.cond.Broadcast()
+}
+
+func (d *download) attach() *downloadReader {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.readers++
+	return &downloadReader{d: d}
+}
+
+func (d *download) release() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.readers--
+	if d.readers == 0 && d.done {
+		d.tmp.Close()
+		os.Remove(d.tmp.Name())
+	}
+}
+
+// Waits for the upstream to answer, returning the size of the file or -1 if unknown
+func (r *downloadReader) wait() (int64, error) {
+	d := r.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for !d.started && !d.done {
+		d.cond.Wait()
+	}
+	if d.done && d.err != nil {
+		return 0, d.err
+	}
+	return d.size, nil
+}
+
+// Reads the file as it is written. The last chunk is held back until the download is
+// verified, so a requester never gets a complete file that failed, and small files that
+// fail are answered with an error status.
+func (r *downloadReader) Read(p []byte) (int, error) {
+	d := r.d
+	d.mu.Lock()
+	var available int64
+	for {
+		available = d.written
+		if !d.done {
+			available -= downloadHoldBack
+		}
+		if d.done && d.err != nil {
+			d.mu.Unlock()
+			return 0, d.err
+		}
+		if r.offset < available {
+			break
+		}
+		if d.done {
+			d.mu.Unlock()
+			return 0, io.EOF
+		}
+		d.cond.Wait()
+	}
+	d.mu.Unlock()
+	if int64(len(p)) > available-r.offset {
+		p = p[:available-r.offset]
+	}
+	n, err := d.tmp.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *downloadReader) Close() error {
+	r.d.release()
+	return nil
+}
+
+// Serves a proxied file while it is downloaded. Returns FileNotFound if it is stored, to be
+// served from the storage, or an error before anything is written.
+func serveDownload(w http.ResponseWriter, u *Upstream, fileUrl *url.URL, repoData *ProjectInfo, expectedSHA256 string) error {
+	reader, err := openDownload(u, fileUrl, repoData, expectedSHA256)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	size, err := reader.wait()
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if n, err := io.Copy(w, reader); err != nil {
+		if n == 0 {
+			w.Header().Del("Content-Length")
+			return err
+		}
+		// Aborts the response, so the requester sees the download failed
+		Logger.Warn("Failed to stream file", "file", repoData.Filename, "error", err)
+		panic(http.ErrAbortHandler)
+	}
+	return nil
+}
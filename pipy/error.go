@@ -13,6 +13,8 @@ func (e *Error) Error() string {
 
 var (
 	RepoNotFound = &Error{Message: "not found", Code: 404}
+	FileNotFound = &Error{Message: "file not found", Code: 404}
+	InvalidPath  = &Error{Message: "invalid path", Code: 400}
 )
 
 func newError(format string, a ...any) *Error {
@@ -20,3 +22,9 @@ func newError(format string, a ...any) *Error {
 	Logger.Error(errMessage)
 	return &Error{Message: errMessage, Code: 500}
 }
+
+func newErrorWithCode(code int, format string, a ...any) *Error {
+	errMessage := fmt.Sprintf(format, a...)
+	Logger.Warn(errMessage)
+	return &Error{Message: errMessage, Code: code}
+}
@@ -0,0 +1,173 @@
+package pipy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pfernandom/go-pypi/pep440"
+)
+
+// Distribution is the information carried by a distribution filename
+type Distribution struct {
+	Filename string
+	Name     string
+	Version  string
+	// Upload filetype of the distribution, e.g. "sdist" or "bdist_wheel"
+	FileType string
+	// Wheel build tag (PEP 427), e.g. "1" or "2_beta"
+	BuildTag string
+	// Compatibility tags (PEP 425) of wheels, a tag can be a dotted set, e.g. "py2.py3"
+	PythonTags   []string
+	AbiTags      []string
+	PlatformTags []string
+	// Python version of eggs and Windows installers, e.g. "2.7"
+	PythonVersion string
+}
+
+var sdistExtensions = []string{".tar.gz", ".tar.bz2", ".tar.xz", ".tar.Z", ".tgz", ".tar", ".zip"}
+
+// Project name as allowed by PEP 508, before normalization
+var projectNameRegex = regexp.MustCompile(`(?i)^[a-z0-9]([a-z0-9._-]*[a-z0-9])?$`)
+
+var buildTagRegex = regexp.MustCompile(`^[0-9][A-Za-z0-9_.]*$`)
+
+// Windows installer suffix of bdist_wininst and bdist_msi, e.g. ".win32-py2.7"
+var installerSuffixRegex = regexp.MustCompile(`\.(win32|win-amd64|win-arm64|linux-[a-z0-9_]+)(?:-py([0-9.]+))?$`)
+
+// Parses a distribution filename: wheels (PEP 427), sdists, eggs, Windows installers and RPMs
+func ParseDistributionFilename(filename string) (*Distribution, error) {
+	switch {
+	case strings.HasSuffix(filename, ".whl"):
+		return parseWheelFilename(filename)
+	case strings.HasSuffix(filename, ".egg"):
+		return parseEggFilename(filename)
+	case strings.HasSuffix(filename, ".exe"):
+		return parseInstallerFilename(filename, ".exe", "bdist_wininst")
+	case strings.HasSuffix(filename, ".msi"):
+		return parseInstallerFilename(filename, ".msi", "bdist_msi")
+	case strings.HasSuffix(filename, ".rpm"):
+		return parseRpmFilename(filename)
+	}
+	for _, extension := range sdistExtensions {
+		if strings.HasSuffix(filename, extension) {
+			name, version, err := splitNameVersion(strings.TrimSuffix(filename, extension))
+			if err != nil {
+				return nil, fmt.Errorf("invalid sdist filename %q: %v", filename, err)
+			}
+			return &Distribution{Filename: filename, Name: name, Version: version, FileType: "sdist"}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid distribution filename %q: unknown extension", filename)
+}
+
+// {name}-{version}(-{build tag})?-{python tag}-{abi tag}-{platform tag}.whl
+func parseWheelFilename(filename string) (*Distribution, error) {
+	parts := strings.Split(strings.TrimSuffix(filename, ".whl"), "-")
+	if len(parts) != 5 && len(parts) != 6 {
+		return nil, fmt.Errorf("invalid wheel filename %q: expected 5 or 6 dash separated parts, got %d", filename, len(parts))
+	}
+	for _, part := range parts {
+		if part == "" {
+			return nil, fmt.Errorf("invalid wheel filename %q: empty part", filename)
+		}
+	}
+	distribution := &Distribution{
+		Filename:     filename,
+		Name:         parts[0],
+		Version:      parts[1],
+		FileType:     "bdist_wheel",
+		PythonTags:   strings.Split(parts[len(parts)-3], "."),
+		AbiTags:      strings.Split(parts[len(parts)-2], "."),
+		PlatformTags: strings.Split(parts[len(parts)-1], "."),
+	}
+	if len(parts) == 6 {
+		if !buildTagRegex.MatchString(parts[2]) {
+			return nil, fmt.Errorf("invalid wheel filename %q: build tag %q must start with a digit", filename, parts[2])
+		}
+		distribution.BuildTag = parts[2]
+	}
+	if !projectNameRegex.MatchString(distribution.Name) {
+		return nil, fmt.Errorf("invalid wheel filename %q: invalid name %q", filename, distribution.Name)
+	}
+	if _, err := pep440.Parse(distribution.Version); err != nil {
+		return nil, fmt.Errorf("invalid wheel filename %q: %v", filename, err)
+	}
+	return distribution, nil
+}
+
+// {name}-{version}(-py{python version}(-{platform})?)?.egg
+func parseEggFilename(filename string) (*Distribution, error) {
+	// The platform may contain dashes, e.g. "linux-x86_64"
+	parts := strings.SplitN(strings.TrimSuffix(filename, ".egg"), "-", 4)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid egg filename %q", filename)
+	}
+	distribution := &Distribution{Filename: filename, Name: parts[0], Version: parts[1], FileType: "bdist_egg"}
+	if len(parts) > 2 {
+		if !strings.HasPrefix(parts[2], "py") {
+			return nil, fmt.Errorf("invalid egg filename %q: invalid python version %q", filename, parts[2])
+		}
+		distribution.PythonVersion = strings.TrimPrefix(parts[2], "py")
+	}
+	if len(parts) > 3 {
+		distribution.PlatformTags = []string{parts[3]}
+	}
+	return distribution, nil
+}
+
+// {name}-{version}(.{platform}(-py{python version})?)?.exe|.msi
+func parseInstallerFilename(filename string, extension string, fileType string) (*Distribution, error) {
+	base := strings.TrimSuffix(filename, extension)
+	distribution := &Distribution{Filename: filename, FileType: fileType}
+	if match := installerSuffixRegex.FindStringSubmatch(base); match != nil {
+		base = strings.TrimSuffix(base, match[0])
+		distribution.PlatformTags = []string{match[1]}
+		distribution.PythonVersion = match[2]
+	}
+	name, version, err := splitNameVersion(base)
+	if err != nil {
+		return nil, fmt.Errorf("invalid installer filename %q: %v", filename, err)
+	}
+	distribution.Name, distribution.Version = name, version
+	return distribution, nil
+}
+
+// {name}-{version}-{release}.{arch}.rpm
+func parseRpmFilename(filename string) (*Distribution, error) {
+	base := strings.TrimSuffix(filename, ".rpm")
+	dot := strings.LastIndex(base, ".")
+	if dot < 0 {
+		return nil, fmt.Errorf("invalid rpm filename %q: missing architecture", filename)
+	}
+	base, arch := base[:dot], base[dot+1:]
+	dash := strings.LastIndex(base, "-")
+	if dash < 0 {
+		return nil, fmt.Errorf("invalid rpm filename %q: missing release", filename)
+	}
+	name, version, err := splitNameVersion(base[:dash])
+	if err != nil {
+		return nil, fmt.Errorf("invalid rpm filename %q: %v", filename, err)
+	}
+	return &Distribution{Filename: filename, Name: name, Version: version, FileType: "bdist_rpm", PlatformTags: []string{arch}}, nil
+}
+
+// Splits "{name}-{version}" where the name of legacy distributions may contain dashes. The
+// first dash followed by a valid version separates them, e.g. "my-package-1.0-1" is
+// "my-package" and "1.0-1". Without a valid version the last dash does.
+func splitNameVersion(base string) (string, string, error) {
+	for i, c := range base {
+		if c != '-' {
+			continue
+		}
+		name, version := base[:i], base[i+1:]
+		if _, err := pep440.Parse(version); err == nil && projectNameRegex.MatchString(name) {
+			return name, version, nil
+		}
+	}
+	dash := strings.LastIndex(base, "-")
+	if dash <= 0 || dash == len(base)-1 {
+		return "", "", fmt.Errorf("cannot split name and version of %q", base)
+	}
+	return base[:dash], base[dash+1:], nil
+}
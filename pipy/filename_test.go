@@ -0,0 +1,54 @@
+package pipy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDistributionFilename(t *testing.T) {
+	tests := map[string]Distribution{
+		"numpy-2.3.4-cp312-cp312-manylinux_2_17_x86_64.manylinux2014_x86_64.whl": {
+			Name: "numpy", Version: "2.3.4", FileType: "bdist_wheel",
+			PythonTags: []string{"cp312"}, AbiTags: []string{"cp312"},
+			PlatformTags: []string{"manylinux_2_17_x86_64", "manylinux2014_x86_64"},
+		},
+		"my_package-1.0-2_beta-py2.py3-none-any.whl": {
+			Name: "my_package", Version: "1.0", FileType: "bdist_wheel", BuildTag: "2_beta",
+			PythonTags: []string{"py2", "py3"}, AbiTags: []string{"none"}, PlatformTags: []string{"any"},
+		},
+		"my_package-1.0.tar.gz":             {Name: "my_package", Version: "1.0", FileType: "sdist"},
+		"my-package-1.0-1.zip":              {Name: "my-package", Version: "1.0-1", FileType: "sdist"},
+		"legacy-pkg-2004d.tar.bz2":          {Name: "legacy-pkg", Version: "2004d", FileType: "sdist"},
+		"setuptools-0.6c11-py2.7.egg":       {Name: "setuptools", Version: "0.6c11", FileType: "bdist_egg", PythonVersion: "2.7"},
+		"my_pkg-1.0-py3.8-linux-x86_64.egg": {Name: "my_pkg", Version: "1.0", FileType: "bdist_egg", PythonVersion: "3.8", PlatformTags: []string{"linux-x86_64"}},
+		"numpy-1.9.2.win32-py2.7.exe":       {Name: "numpy", Version: "1.9.2", FileType: "bdist_wininst", PythonVersion: "2.7", PlatformTags: []string{"win32"}},
+		"my-package-1.0.win-amd64.msi":      {Name: "my-package", Version: "1.0", FileType: "bdist_msi", PlatformTags: []string{"win-amd64"}},
+		"my-package-1.0-1.noarch.rpm":       {Name: "my-package", Version: "1.0", FileType: "bdist_rpm", PlatformTags: []string{"noarch"}},
+	}
+	for filename, want := range tests {
+		t.Run(filename, func(t *testing.T) {
+			want.Filename = filename
+			got, err := ParseDistributionFilename(filename)
+			assert.NoError(t, err)
+			assert.Equal(t, &want, got)
+		})
+	}
+}
+
+func TestParseDistributionFilenameInvalid(t *testing.T) {
+	for _, filename := range []string{
+		"numpy-1.26.0.whl",
+		"numpy-1.0-beta-py3-none-any.whl",
+		"numpy-latest-py3-none-any.whl",
+		"numpy--py3-none-any.whl",
+		"numpy.tar.gz",
+		"numpy-1.0.txt",
+		"numpy-1.0-cp312.egg",
+	} {
+		t.Run(filename, func(t *testing.T) {
+			_, err := ParseDistributionFilename(filename)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -1,211 +1,372 @@
 package pipy
 
 import (
+	"bytes"
 	"encoding/json"
-	"fmt"
 	"io"
 	"net/http"
 	"net/url"
-	"os"
-	"path/filepath"
+	"path"
+	"strings"
+
+	"github.com/pfernandom/go-pypi/pep440"
 )
 
 var storagePath = "./uploads"
 var metadataFileName = "request.json"
 var responseMetadataFileName = "response.json"
 
-func SetupStorage() {
-	if _, err := os.Stat(storagePath); os.IsNotExist(err) {
-		os.MkdirAll(storagePath, 0755)
-	}
-}
-
 func GetIndexResponse() (*IndexResponse, error) {
-	repoPath := filepath.Join(storagePath)
-	if _, err := os.Stat(repoPath); os.IsNotExist(err) {
-		return nil, RepoNotFound
-	}
-	repos, err := os.ReadDir(repoPath)
+	repos, err := index.Projects()
 	if err != nil {
-		return nil, newError("failed to read repos: %v", err)
+		return nil, err
 	}
 	projects := []Project{}
 	for _, repo := range repos {
 		projects = append(projects, Project{
-			Name: repo.Name(),
+			Name: repo,
 		})
 	}
-	return &IndexResponse{Projects: projects}, nil
+	return &IndexResponse{Meta: Meta{ApiVersion: ApiVersion}, Projects: projects}, nil
 }
 
-// Gets the python package from the storage path
+// Gets the descriptor of a project hosted locally. Projects whose files were all downloaded
+// from the upstreams are left to the proxy, so it sees their new releases. Unless the project
+// is merged, the files downloaded from the upstreams aren't listed with the uploaded ones.
 func GetPackageDescriptor(packageName string) (*Response, error) {
-	repoPath := filepath.Join(storagePath, NormalizeProjectName(packageName))
-	if _, err := os.Stat(repoPath); os.IsNotExist(err) {
+	releases, err := indexReleases(packageName)
+	if err != nil {
+		return nil, err
+	}
+	if !hasUploadedFiles(releases) {
 		return nil, RepoNotFound
 	}
-	versions, err := os.ReadDir(repoPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, RepoNotFound
-		}
-		return nil, fmt.Errorf("failed to read versions: %v", err)
+	if !matchProject(mergedProjects, packageName) {
+		releases = uploadedReleases(releases)
 	}
-	files := []File{}
-	for _, version := range versions {
-		versionPath := filepath.Join(repoPath, version.Name())
-		repoFiles, err := os.ReadDir(versionPath)
-		if err != nil {
-			return nil, newError("failed to read files: %v", err)
-		}
+	return releasesDescriptor(packageName, releases), nil
+}
 
-		var metadata UploadRequestForm
-		var projectFiles []*os.DirEntry
-		for _, file := range repoFiles {
-			if file.Name() == metadataFileName {
-				meta, err := os.ReadFile(filepath.Join(versionPath, file.Name()))
-				if err != nil {
-					return nil, newError("failed to read metadata file: %v", err)
-				}
-				err = json.Unmarshal(meta, &metadata)
-				if err != nil {
-					return nil, newError("failed to unmarshal metadata: %v", err)
-				}
-			} else {
-				projectFiles = append(projectFiles, &file)
+// Reports whether a project has uploaded files, or no files at all. Files proxied before
+// upstreams were recorded on them count as uploaded.
+func hasUploadedFiles(releases []ReleaseRecord) bool {
+	hasFiles := false
+	for _, release := range releases {
+		for _, record := range release.Files {
+			if record.Upstream == "" {
+				return true
 			}
+			hasFiles = true
 		}
+	}
+	return !hasFiles
+}
 
-		for _, file := range projectFiles {
-			file := *file
-			if file.Name() == metadataFileName {
-				continue
-			}
-			sha256, err := getFileSHA256(filepath.Join(versionPath, file.Name()))
-			if err != nil {
-				return nil, newError("failed to get file SHA256: %v", err)
-			}
-			urlPath, err := url.JoinPath("/files", packageName, version.Name(), file.Name())
-			if err != nil {
-				return nil, newError("failed to join URL path: %v", err)
+// Drops the files downloaded from the upstreams, and the releases only having such files
+func uploadedReleases(releases []ReleaseRecord) []ReleaseRecord {
+	uploaded := []ReleaseRecord{}
+	for _, release := range releases {
+		files := []FileRecord{}
+		for _, record := range release.Files {
+			if record.Upstream == "" {
+				files = append(files, record)
 			}
-			files = append(files, File{
-				Filename: file.Name(),
+		}
+		if len(files) == 0 && len(release.Files) > 0 {
+			continue
+		}
+		release.Files = files
+		uploaded = append(uploaded, release)
+	}
+	return uploaded
+}
+
+// Gets the releases of a project from the index, or from the storage if it isn't indexed
+func indexReleases(packageName string) ([]ReleaseRecord, error) {
+	releases, err := index.Releases(packageName)
+	if err == RepoNotFound {
+		return reindexProject(packageName)
+	}
+	return releases, err
+}
+
+// Gets the descriptor of all the files of a project in the index, uploaded or proxied
+func indexDescriptor(packageName string) (*Response, error) {
+	releases, err := indexReleases(packageName)
+	if err != nil {
+		return nil, err
+	}
+	return releasesDescriptor(packageName, releases), nil
+}
+
+func releasesDescriptor(packageName string, releases []ReleaseRecord) *Response {
+	files := []File{}
+	versionNumbers := []string{}
+	for _, release := range releases {
+		versionNumbers = append(versionNumbers, release.Version)
+		for _, record := range release.Files {
+			// Relative to the descriptor URL, /simple/<package>/
+			urlPath := url.PathEscape(release.Version) + "/" + url.PathEscape(record.Filename)
+			size := record.Size
+			uploadTime := record.UploadTime.UTC().Format(UploadTimeFormat)
+			file := File{
+				Filename: record.Filename,
 				URL:      urlPath,
 				Hashes: FileHashes{
-					SHA256: sha256,
+					SHA256: record.Hashes.SHA256,
 				},
-			})
+				Size:       &size,
+				UploadTime: &uploadTime,
+				Origin:     record.Upstream,
+			}
+			requiresPython := record.RequiresPython
+			if requiresPython == "" && release.Metadata != nil {
+				requiresPython = release.Metadata.RequiresPython
+			}
+			if requiresPython != "" {
+				file.RequiresPython = &requiresPython
+			}
+			if record.CoreMetadata != nil {
+				var coreMetadata any = map[string]string{"sha256": record.CoreMetadata.SHA256}
+				file.CoreMetadata = &coreMetadata
+				file.DistInfoMetadata = &coreMetadata
+			}
+			if record.Yanked {
+				var yanked any = true
+				if record.YankedReason != "" {
+					yanked = record.YankedReason
+				}
+				file.Yanked = &yanked
+			}
+			files = append(files, file)
 		}
 	}
-	versionNumbers := []string{}
-	for _, version := range versions {
-		versionNumbers = append(versionNumbers, version.Name())
-	}
 	return &Response{
+		Meta:     Meta{ApiVersion: ApiVersion},
 		Name:     packageName,
 		Versions: versionNumbers,
 		Files:    files,
-	}, nil
+	}
 }
 
 // Saves the file from the multipart form
 func SavePublishRequestFile(uploadRequest *UploadRequestForm, r *http.Request) error {
 	file, header, err := r.FormFile("content")
 	if err != nil {
-		return newError("failed to get file from form: %v", err)
+		return newErrorWithCode(400, "Upload payload does not have a file: %v", err)
 	}
-	repoPath, err := getPackageVersionPath(uploadRequest.Name, uploadRequest.Version)
+	defer file.Close()
+	if err := validatePathSegment(header.Filename); err != nil {
+		return newErrorWithCode(400, "Invalid distribution file. %q is not a valid filename.", header.Filename)
+	}
+	if err := validateDistribution(uploadRequest, header.Filename, file, header.Size); err != nil {
+		return err
+	}
+	// Concurrent uploads of the same file are checked and stored one at a time
+	defer lockKey(path.Join(packageVersionKey(uploadRequest.Name, uploadRequest.Version), header.Filename))()
+	previous, identical, err := checkOverwrite(uploadRequest.Name, uploadRequest.Version, header.Filename, file, header.Size)
+	if err != nil || identical {
+		return err
+	}
+	// The digests are verified while the file is stored, a mismatch discards it
+	record := &FileRecord{
+		Filename:       header.Filename,
+		FileType:       uploadRequest.FileType,
+		PyVersion:      uploadRequest.Pyversion,
+		RequiresPython: uploadRequest.RequiresPython,
+	}
+	// A replaced file stays yanked until it is un-yanked
+	if previous != nil {
+		record.Yanked, record.YankedReason = previous.Yanked, previous.YankedReason
+	}
+	// twine sends the username, or __token__ for API tokens
+	if username, _, ok := r.BasicAuth(); ok {
+		record.Uploader = username
+	}
+	_, err = storeFileWithRecord(uploadRequest.Name, uploadRequest.Version, record, file, FileDigests{
+		MD5:        uploadRequest.Md5Digest,
+		SHA256:     uploadRequest.Sha256Digest,
+		Blake2b256: uploadRequest.Blake2256Digest,
+	})
+	return err
+}
+
+// Checks that the filename and the metadata inside the archive match the name and version
+// of the upload. Wheels and sdists without readable metadata are rejected, formats whose
+// archives can't be read are only checked by filename.
+func validateDistribution(uploadRequest *UploadRequestForm, filename string, file io.ReaderAt, size int64) error {
+	distribution, err := ParseDistributionFilename(filename)
 	if err != nil {
-		return newError("failed to get package version path: %v", err)
+		return newErrorWithCode(400, "Invalid distribution file. %v", err)
+	}
+	if NormalizeProjectName(distribution.Name) != NormalizeProjectName(uploadRequest.Name) {
+		return newErrorWithCode(400, "Start filename for %q with %q.", uploadRequest.Name, strings.ReplaceAll(NormalizeProjectName(uploadRequest.Name), "-", "_"))
+	}
+	if pep440.Compare(distribution.Version, uploadRequest.Version) != 0 {
+		return newErrorWithCode(400, "Version in filename should be %q not %q.", uploadRequest.Version, distribution.Version)
 	}
-	filePath := filepath.Join(repoPath, header.Filename)
-	dst, err := os.Create(filePath)
+
+	metadata, err := extractDistributionMetadata(distribution, file, size)
 	if err != nil {
-		return newError("failed to create file: %v", err)
+		return newErrorWithCode(400, "Invalid distribution file. %v", err)
 	}
-	defer dst.Close()
-	defer file.Close()
-	if _, err := io.Copy(dst, file); err != nil {
-		return newError("failed to copy file: %v", err)
+	if metadata == nil {
+		return nil
+	}
+	headers, err := parseCoreMetadata(metadata)
+	if err != nil {
+		return newErrorWithCode(400, "Invalid distribution file. %v", err)
+	}
+	if name := headers.Get("Name"); NormalizeProjectName(name) != NormalizeProjectName(uploadRequest.Name) {
+		return newErrorWithCode(400, "The name in the metadata of %s (%q) does not match the upload (%q).", filename, name, uploadRequest.Name)
+	}
+	if version := headers.Get("Version"); pep440.Compare(version, uploadRequest.Version) != 0 {
+		return newErrorWithCode(400, "The version in the metadata of %s (%q) does not match the upload (%q).", filename, version, uploadRequest.Version)
 	}
 	return nil
 }
 
-// Saves the upload request data to a file
+// Saves the release level metadata of an upload, merged with the metadata of the files
+// uploaded before. The metadata of the file itself is kept in its record.
 func SaveUploadRequestData(request *UploadRequestForm) error {
-	requestPath, err := getPackageVersionPath(request.Name, request.Version)
-	if err != nil {
-		return newError("failed to get package version path: %v", err)
+	version := releaseVersion(request.Name, request.Version)
+	versionKey := packageVersionKey(request.Name, version)
+	requestKey := path.Join(versionKey, metadataFileName)
+	defer lockKey(requestKey)()
+	release := &UploadRequestForm{}
+	if existing, err := readUploadRequestData(versionKey); err == nil {
+		release = existing
+	} else if err != FileNotFound {
+		return err
 	}
-	requestFile := filepath.Join(requestPath, metadataFileName)
-	requestData, err := json.MarshalIndent(request, "", "  ")
+	release = mergeReleaseMetadata(release, request)
+	requestData, err := json.MarshalIndent(release, "", "  ")
 	if err != nil {
 		return newError("failed to marshal request: %v", err)
 	}
-	err = os.WriteFile(requestFile, requestData, 0644)
+	err = storage.Put(requestKey, bytes.NewReader(requestData))
 	if err != nil {
 		return newError("failed to write request file: %v", err)
 	}
-	return nil
+	return index.PutRelease(request.Name, version, release)
 }
 
-func getFileSHA256(filePath string) (string, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return "", newError("failed to open file: %v", err)
+// Merges an upload into the release metadata: the fields the upload sets replace the stored
+// ones, the others are kept. The fields describing a single file belong to its record and
+// are left out.
+func mergeReleaseMetadata(release *UploadRequestForm, upload *UploadRequestForm) *UploadRequestForm {
+	return &UploadRequestForm{
+		Name:                   mergeField(release.Name, upload.Name),
+		Version:                mergeField(release.Version, upload.Version),
+		MetadataVersion:        mergeField(release.MetadataVersion, upload.MetadataVersion),
+		Summary:                mergeField(release.Summary, upload.Summary),
+		Description:            mergeField(release.Description, upload.Description),
+		DescriptionContentType: mergeField(release.DescriptionContentType, upload.DescriptionContentType),
+		Keywords:               mergeField(release.Keywords, upload.Keywords),
+		HomePage:               mergeField(release.HomePage, upload.HomePage),
+		DownloadUrl:            mergeField(release.DownloadUrl, upload.DownloadUrl),
+		Author:                 mergeField(release.Author, upload.Author),
+		AuthorEmail:            mergeField(release.AuthorEmail, upload.AuthorEmail),
+		Maintainer:             mergeField(release.Maintainer, upload.Maintainer),
+		MaintainerEmail:        mergeField(release.MaintainerEmail, upload.MaintainerEmail),
+		License:                mergeField(release.License, upload.License),
+		LicenseExpression:      mergeField(release.LicenseExpression, upload.LicenseExpression),
+		LicenseFiles:           mergeList(release.LicenseFiles, upload.LicenseFiles),
+		Classifiers:            mergeList(release.Classifiers, upload.Classifiers),
+		Platforms:              mergeList(release.Platforms, upload.Platforms),
+		SupportedPlatforms:     mergeList(release.SupportedPlatforms, upload.SupportedPlatforms),
+		RequiresPython:         mergeField(release.RequiresPython, upload.RequiresPython),
+		RequiresDist:           mergeList(release.RequiresDist, upload.RequiresDist),
+		RequiresExternal:       mergeList(release.RequiresExternal, upload.RequiresExternal),
+		ProvidesDist:           mergeList(release.ProvidesDist, upload.ProvidesDist),
+		ObsoletesDist:          mergeList(release.ObsoletesDist, upload.ObsoletesDist),
+		ProvidesExtra:          mergeList(release.ProvidesExtra, upload.ProvidesExtra),
+		ProjectUrls:            mergeList(release.ProjectUrls, upload.ProjectUrls),
+		Dynamic:                mergeList(release.Dynamic, upload.Dynamic),
+		Requires:               mergeList(release.Requires, upload.Requires),
+		Provides:               mergeList(release.Provides, upload.Provides),
+		Obsoletes:              mergeList(release.Obsoletes, upload.Obsoletes),
 	}
-	defer file.Close()
-	data, err := io.ReadAll(file)
-	if err != nil {
-		return "", newError("failed to read file: %v", err)
-	}
-	return CalculateSHA256(data), nil
 }
 
-func GetFile(repo string, version string, filename string) (io.Reader, error) {
-	repoPath := filepath.Join(storagePath, NormalizeProjectName(repo), version, filename)
-	if _, err := os.Stat(repoPath); os.IsNotExist(err) {
-		return nil, newError("file not found: %v", err)
+func mergeField(stored string, uploaded string) string {
+	if uploaded != "" {
+		return uploaded
 	}
-	return os.Open(repoPath)
+	return stored
 }
 
-func SaveFileFromPyPI(url *url.URL, filename string, repoData *ProjectInfo) error {
-	repoPath, err := getPackageVersionPath(repoData.Repo, repoData.Version)
-	if err != nil {
-		return newError("failed to get package version path: %v", err)
+// Empty lists are unset, the form parser fills every list field
+func mergeList(stored []string, uploaded []string) []string {
+	if len(uploaded) > 0 {
+		return uploaded
 	}
-	filePath := filepath.Join(repoPath, filename)
-	// If the file already exists, don't download it again
-	if _, err := os.Stat(filePath); err == nil {
-		return nil
+	return stored
+}
+
+func readUploadRequestData(versionKey string) (*UploadRequestForm, error) {
+	file, err := storage.Open(path.Join(versionKey, metadataFileName))
+	if err == FileNotFound {
+		return nil, FileNotFound
 	}
-	file, err := os.Create(filePath)
 	if err != nil {
-		return newError("failed to create file %s: %v", filePath, err)
+		return nil, newError("failed to open request file: %v", err)
 	}
 	defer file.Close()
-	response, err := http.Get(url.String())
+	var request UploadRequestForm
+	if err := json.NewDecoder(file).Decode(&request); err != nil {
+		return nil, newError("failed to unmarshal request file: %v", err)
+	}
+	return &request, nil
+}
+
+// Gets the storage key of a file, or of its PEP 658 core metadata when filename ends in
+// .metadata, to be served by FileServer
+func FileKey(repo string, version string, filename string) (string, error) {
+	if err := validatePathSegments(repo, version, filename); err != nil {
+		return "", err
+	}
+	if strings.HasSuffix(filename, coreMetadataSuffix) {
+		return coreMetadataKey(packageVersionKey(repo, version), strings.TrimSuffix(filename, coreMetadataSuffix)), nil
+	}
+	return path.Join(packageVersionKey(repo, version), filename), nil
+}
+
+// Gets a stored file, or its PEP 658 core metadata when filename ends in .metadata
+func GetFile(repo string, version string, filename string) (io.ReadCloser, error) {
+	fileKey, err := FileKey(repo, version, filename)
 	if err != nil {
-		return newError("failed to get file from PyPI: %v", err)
+		return nil, err
 	}
-	defer response.Body.Close()
-	_, err = io.Copy(file, response.Body)
+	file, err := storage.Open(fileKey)
 	if err != nil {
-		return newError("failed to copy file: %v", err)
+		if err == FileNotFound {
+			return nil, FileNotFound
+		}
+		return nil, newError("failed to open file: %v", err)
 	}
+	return file, nil
+}
 
-	return nil
+func packageVersionKey(packageName string, version string) string {
+	return path.Join(NormalizeProjectName(packageName), releaseVersion(packageName, version))
 }
 
-func getPackageVersionPath(packageName string, version string) (string, error) {
-	packagePath := filepath.Join(storagePath, NormalizeProjectName(packageName), version)
-	if _, err := os.Stat(packagePath); os.IsNotExist(err) {
-		err := os.MkdirAll(packagePath, 0755)
-		if err != nil {
-			return "", newError("failed to create directory: %v", err)
+// Resolves the release a version belongs to. A version equal under PEP 440 to an existing
+// release (e.g. 1.0.0 and 1.0) belongs to it, others are normalized. Invalid versions are
+// kept as is.
+func releaseVersion(packageName string, version string) string {
+	parsed, err := pep440.Parse(version)
+	if err != nil {
+		return version
+	}
+	versions, err := index.Versions(packageName)
+	if err == nil {
+		for _, existing := range versions {
+			if existingVersion, err := pep440.Parse(existing); err == nil && existingVersion.Compare(parsed) == 0 {
+				return existing
+			}
 		}
 	}
-	return packagePath, nil
+	return parsed.String()
 }
@@ -0,0 +1,89 @@
+package pipy
+
+import (
+	"html/template"
+	"io"
+)
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <meta name="pypi:repository-version" content="{{.Meta.ApiVersion}}">
+    <title>Simple index</title>
+  </head>
+  <body>
+{{- range .Projects}}
+    <a href="{{.Name}}/">{{.Name}}</a><br/>
+{{- end}}
+  </body>
+</html>
+`))
+
+var descriptorTemplate = template.Must(template.New("descriptor").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <meta name="pypi:repository-version" content="{{.ApiVersion}}">
+    <title>Links for {{.Name}}</title>
+  </head>
+  <body>
+    <h1>Links for {{.Name}}</h1>
+{{- range .Files}}
+    <a href="{{.Href}}"
+      {{- with .RequiresPython}} data-requires-python="{{.}}"{{end}}
+      {{- if .CoreMetadata}} data-core-metadata="{{.CoreMetadataHash}}" data-dist-info-metadata="{{.CoreMetadataHash}}"{{end}}
+      {{- if .Yanked}} data-yanked="{{.YankedReason}}"{{end}}
+      {{- with .Origin}} data-origin="{{.}}"{{end}}>{{.Filename}}</a><br/>
+{{- end}}
+  </body>
+</html>
+`))
+
+type htmlFile struct {
+	Filename         string
+	Href             string
+	RequiresPython   string
+	CoreMetadata     bool
+	CoreMetadataHash string
+	Yanked           bool
+	YankedReason     string
+	Origin           string
+}
+
+// Writes the project list as a PEP 503 HTML page
+func WriteIndexHTML(w io.Writer, response *IndexResponse) error {
+	return indexTemplate.Execute(w, response)
+}
+
+// Writes the project files as a PEP 503 HTML page
+func WriteDescriptorHTML(w io.Writer, response *Response) error {
+	files := []htmlFile{}
+	for _, file := range response.Files {
+		href := file.URL
+		if file.Hashes.SHA256 != "" {
+			href += "#sha256=" + file.Hashes.SHA256
+		}
+		yankedReason, yanked := file.YankedReason()
+		coreMetadataHash, coreMetadata := file.CoreMetadataHash()
+		if coreMetadataHash == "" {
+			coreMetadataHash = "true"
+		}
+		htmlFile := htmlFile{
+			Filename:         file.Filename,
+			Href:             href,
+			CoreMetadata:     coreMetadata,
+			CoreMetadataHash: coreMetadataHash,
+			Yanked:           yanked,
+			YankedReason:     yankedReason,
+			Origin:           file.Origin,
+		}
+		if file.RequiresPython != nil {
+			htmlFile.RequiresPython = *file.RequiresPython
+		}
+		files = append(files, htmlFile)
+	}
+	return descriptorTemplate.Execute(w, struct {
+		ApiVersion string
+		Name       string
+		Files      []htmlFile
+	}{ApiVersion, response.Name, files})
+}
@@ -0,0 +1,461 @@
+package pipy
+
+import (
+	"encoding/json"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pfernandom/go-pypi/pep440"
+	bolt "go.etcd.io/bbolt"
+)
+
+var indexPath = "./index.db"
+
+// Index is the embedded metadata database of the stored projects, releases and files.
+// The storage remains the source of truth, Reindex rebuilds the index from it, and projects
+// missing from the index are looked up in it, at most once every storageMissTTL.
+//
+// Layout: projects/<project>/<version>/{release, files/<filename>}, and the cached upstream
+// simple pages in upstream-descriptors/<upstream>/<project>
+type Index struct {
+	db *bolt.DB
+	// Time projects missing from the index were last not found in the storage either, by
+	// normalized name
+	storageMisses sync.Map
+}
+
+// How long a project not found in the storage isn't looked up again, e.g. for the projects
+// only proxied
+var storageMissTTL = time.Minute
+
+// Release of a project with the metadata of its files
+type ReleaseRecord struct {
+	Version  string
+	Metadata *UploadRequestForm
+	Files    []FileRecord
+}
+
+var (
+	projectsBucket = []byte("projects")
+	filesBucket    = []byte("files")
+	releaseKey     = []byte("release")
+	// Not rebuilt by Reindex, the upstreams are their source
+	descriptorsBucket = []byte("upstream-descriptors")
+)
+
+var index *Index
+
+// Opens the index used by the package functions, closing the previous one
+func SetupIndex(path string) error {
+	if path == "" {
+		path = indexPath
+	}
+	if index != nil {
+		index.Close()
+		index = nil
+	}
+	i, err := OpenIndex(path)
+	if err != nil {
+		return err
+	}
+	index = i
+	return nil
+}
+
+func OpenIndex(path string) (*Index, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, newError("failed to open index %s: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(projectsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(descriptorsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, newError("failed to initialize index: %v", err)
+	}
+	return &Index{db: db}, nil
+}
+
+func (i *Index) Close() error {
+	return i.db.Close()
+}
+
+func releaseBucket(tx *bolt.Tx, project string, version string) (*bolt.Bucket, error) {
+	projectBucket, err := tx.Bucket(projectsBucket).CreateBucketIfNotExists([]byte(project))
+	if err != nil {
+		return nil, err
+	}
+	return projectBucket.CreateBucketIfNotExists([]byte(version))
+}
+
+func putRelease(tx *bolt.Tx, project string, version string, metadata *UploadRequestForm) error {
+	bucket, err := releaseBucket(tx, project, version)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(releaseKey, data)
+}
+
+func putFile(tx *bolt.Tx, project string, version string, record *FileRecord) error {
+	bucket, err := releaseBucket(tx, project, version)
+	if err != nil {
+		return err
+	}
+	files, err := bucket.CreateBucketIfNotExists(filesBucket)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return files.Put([]byte(record.Filename), data)
+}
+
+func putReleases(tx *bolt.Tx, project string, releases []ReleaseRecord) error {
+	for _, release := range releases {
+		if _, err := releaseBucket(tx, project, release.Version); err != nil {
+			return err
+		}
+		if release.Metadata != nil {
+			if err := putRelease(tx, project, release.Version, release.Metadata); err != nil {
+				return err
+			}
+		}
+		for _, file := range release.Files {
+			if err := putFile(tx, project, release.Version, &file); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Saves the release level metadata of a project version
+func (i *Index) PutRelease(project string, version string, metadata *UploadRequestForm) error {
+	err := i.db.Update(func(tx *bolt.Tx) error {
+		return putRelease(tx, NormalizeProjectName(project), version, metadata)
+	})
+	if err != nil {
+		return newError("failed to index release: %v", err)
+	}
+	return nil
+}
+
+// Saves the record of a file of a project version
+func (i *Index) PutFile(project string, version string, record *FileRecord) error {
+	err := i.db.Update(func(tx *bolt.Tx) error {
+		return putFile(tx, NormalizeProjectName(project), version, record)
+	})
+	if err != nil {
+		return newError("failed to index file: %v", err)
+	}
+	return nil
+}
+
+// Removes the record of a file, and its release and project once they are empty
+func (i *Index) DeleteFile(project string, version string, filename string) error {
+	project = NormalizeProjectName(project)
+	err := i.db.Update(func(tx *bolt.Tx) error {
+		projectBucket := tx.Bucket(projectsBucket).Bucket([]byte(project))
+		if projectBucket == nil {
+			return nil
+		}
+		bucket := projectBucket.Bucket([]byte(version))
+		if bucket == nil {
+			return nil
+		}
+		files := bucket.Bucket(filesBucket)
+		if files == nil {
+			return nil
+		}
+		if err := files.Delete([]byte(filename)); err != nil {
+			return err
+		}
+		if key, _ := files.Cursor().First(); key != nil || bucket.Get(releaseKey) != nil {
+			return nil
+		}
+		if err := projectBucket.DeleteBucket([]byte(version)); err != nil {
+			return err
+		}
+		if key, _ := projectBucket.Cursor().First(); key != nil {
+			return nil
+		}
+		return tx.Bucket(projectsBucket).DeleteBucket([]byte(project))
+	})
+	if err != nil {
+		return newError("failed to delete file from index: %v", err)
+	}
+	return nil
+}
+
+// Lists the names of the indexed projects
+func (i *Index) Projects() ([]string, error) {
+	projects := []string{}
+	err := i.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(projectsBucket).ForEachBucket(func(name []byte) error {
+			projects = append(projects, string(name))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, newError("failed to read index: %v", err)
+	}
+	return projects, nil
+}
+
+// Lists the versions of a project, or RepoNotFound
+func (i *Index) Versions(project string) ([]string, error) {
+	versions := []string{}
+	err := i.db.View(func(tx *bolt.Tx) error {
+		projectBucket := tx.Bucket(projectsBucket).Bucket([]byte(NormalizeProjectName(project)))
+		if projectBucket == nil {
+			return RepoNotFound
+		}
+		return projectBucket.ForEachBucket(func(version []byte) error {
+			versions = append(versions, string(version))
+			return nil
+		})
+	})
+	if err == RepoNotFound {
+		return nil, RepoNotFound
+	}
+	if err != nil {
+		return nil, newError("failed to read index: %v", err)
+	}
+	pep440.Sort(versions)
+	return versions, nil
+}
+
+// Gets the releases of a project in PEP 440 order, or RepoNotFound
+func (i *Index) Releases(project string) ([]ReleaseRecord, error) {
+	releases := []ReleaseRecord{}
+	err := i.db.View(func(tx *bolt.Tx) error {
+		projectBucket := tx.Bucket(projectsBucket).Bucket([]byte(NormalizeProjectName(project)))
+		if projectBucket == nil {
+			return RepoNotFound
+		}
+		return projectBucket.ForEachBucket(func(version []byte) error {
+			bucket := projectBucket.Bucket(version)
+			release := ReleaseRecord{Version: string(version), Files: []FileRecord{}}
+			if data := bucket.Get(releaseKey); data != nil {
+				release.Metadata = &UploadRequestForm{}
+				if err := json.Unmarshal(data, release.Metadata); err != nil {
+					return err
+				}
+			}
+			if files := bucket.Bucket(filesBucket); files != nil {
+				err := files.ForEach(func(_ []byte, data []byte) error {
+					var record FileRecord
+					if err := json.Unmarshal(data, &record); err != nil {
+						return err
+					}
+					release.Files = append(release.Files, record)
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+			releases = append(releases, release)
+			return nil
+		})
+	})
+	if err == RepoNotFound {
+		return nil, RepoNotFound
+	}
+	if err != nil {
+		return nil, newError("failed to read index: %v", err)
+	}
+	sort.SliceStable(releases, func(i, j int) bool {
+		return pep440.Compare(releases[i].Version, releases[j].Version) < 0
+	})
+	return releases, nil
+}
+
+func descriptorKey(upstream string, project string) []byte {
+	return []byte(upstream + "/" + NormalizeProjectName(project))
+}
+
+// Gets the cached simple page of a project from an upstream, or FileNotFound
+func (i *Index) GetDescriptor(upstream string, project string) (*CachedDescriptor, error) {
+	var cached *CachedDescriptor
+	err := i.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(descriptorsBucket).Get(descriptorKey(upstream, project))
+		if data == nil {
+			return FileNotFound
+		}
+		cached = &CachedDescriptor{}
+		return json.Unmarshal(data, cached)
+	})
+	if err == FileNotFound {
+		return nil, err
+	}
+	if err != nil {
+		return nil, newError("failed to read cached descriptor: %v", err)
+	}
+	return cached, nil
+}
+
+// Caches the simple page of a project from an upstream
+func (i *Index) PutDescriptor(upstream string, project string, cached *CachedDescriptor) error {
+	data, err := json.Marshal(cached)
+	if err != nil {
+		return newError("failed to marshal cached descriptor: %v", err)
+	}
+	err = i.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(descriptorsBucket).Put(descriptorKey(upstream, project), data)
+	})
+	if err != nil {
+		return newError("failed to cache descriptor: %v", err)
+	}
+	return nil
+}
+
+// Removes the cached simple page of a project from an upstream
+func (i *Index) DeleteDescriptor(upstream string, project string) error {
+	err := i.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(descriptorsBucket).Delete(descriptorKey(upstream, project))
+	})
+	if err != nil {
+		return newError("failed to delete cached descriptor: %v", err)
+	}
+	return nil
+}
+
+// Rebuilds the index from the files in the storage
+func Reindex() error {
+	projects, err := scanStorage()
+	if err != nil {
+		return err
+	}
+	err = index.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(projectsBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucket(projectsBucket); err != nil {
+			return err
+		}
+		for project, releases := range projects {
+			if err := putReleases(tx, project, releases); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return newError("failed to rebuild index: %v", err)
+	}
+	Logger.Info("Rebuilt index", "projects", len(projects))
+	return nil
+}
+
+// Walks <project>/<version>/<file> in the storage, reading the records of the files
+func scanStorage() (map[string][]ReleaseRecord, error) {
+	projects := map[string][]ReleaseRecord{}
+	repos, err := storage.List("")
+	if err == FileNotFound {
+		return projects, nil
+	}
+	if err != nil {
+		return nil, newError("failed to read repos: %v", err)
+	}
+	for _, repo := range repos {
+		if !repo.IsDir {
+			continue
+		}
+		releases, err := scanProject(repo.Name)
+		if err != nil {
+			return nil, err
+		}
+		projects[repo.Name] = releases
+	}
+	return projects, nil
+}
+
+// Walks <project>/<version>/<file> in the storage for a single project
+func scanProject(project string) ([]ReleaseRecord, error) {
+	versions, err := storage.List(project)
+	if err == FileNotFound {
+		return []ReleaseRecord{}, nil
+	}
+	if err != nil {
+		return nil, newError("failed to read versions: %v", err)
+	}
+	releases := []ReleaseRecord{}
+	for _, version := range versions {
+		if !version.IsDir {
+			continue
+		}
+		release, err := scanRelease(path.Join(project, version.Name), version.Name)
+		if err != nil {
+			return nil, err
+		}
+		releases = append(releases, *release)
+	}
+	return releases, nil
+}
+
+// Indexes a project missing from the index from the storage, e.g. one uploaded through
+// another replica sharing the storage. Returns RepoNotFound if it isn't stored either, or
+// wasn't the last time it was looked up.
+func reindexProject(project string) ([]ReleaseRecord, error) {
+	project = NormalizeProjectName(project)
+	if missedAt, ok := index.storageMisses.Load(project); ok && time.Since(missedAt.(time.Time)) < storageMissTTL {
+		return nil, RepoNotFound
+	}
+	releases, err := scanProject(project)
+	if err != nil {
+		return nil, err
+	}
+	if len(releases) == 0 {
+		index.storageMisses.Store(project, time.Now())
+		return nil, RepoNotFound
+	}
+	err = index.db.Update(func(tx *bolt.Tx) error {
+		return putReleases(tx, project, releases)
+	})
+	if err != nil {
+		return nil, newError("failed to index project: %v", err)
+	}
+	Logger.Info("Indexed project found in the storage", "project", project)
+	return index.Releases(project)
+}
+
+func scanRelease(versionKey string, version string) (*ReleaseRecord, error) {
+	files, err := storage.List(versionKey)
+	if err != nil {
+		return nil, newError("failed to read files: %v", err)
+	}
+	release := &ReleaseRecord{Version: version, Files: []FileRecord{}}
+	for _, file := range files {
+		if file.IsDir {
+			continue
+		}
+		if file.Name == metadataFileName {
+			metadata, err := readUploadRequestData(versionKey)
+			if err != nil {
+				return nil, err
+			}
+			release.Metadata = metadata
+			continue
+		}
+		record, err := getFileRecord(versionKey, file.Name)
+		if err != nil {
+			return nil, err
+		}
+		release.Files = append(release.Files, *record)
+	}
+	return release, nil
+}
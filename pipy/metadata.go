@@ -0,0 +1,243 @@
+package pipy
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// Suffix of the PEP 658 core metadata file of a distribution
+var coreMetadataSuffix = ".metadata"
+
+// Largest core metadata file read from an archive, so a small compressed archive can't
+// exhaust the memory
+var maxCoreMetadataSize int64 = 4 << 20
+
+func coreMetadataKey(versionKey string, filename string) string {
+	return path.Join(versionKey, fileRecordsDir, filename+coreMetadataSuffix)
+}
+
+// Reads a core metadata file, failing if it is larger than maxCoreMetadataSize
+func readCoreMetadata(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxCoreMetadataSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxCoreMetadataSize {
+		return nil, newError("core metadata is larger than %d bytes", maxCoreMetadataSize)
+	}
+	return data, nil
+}
+
+// Reads the .dist-info/METADATA file of a wheel
+func extractWheelMetadata(r io.ReaderAt, size int64) ([]byte, error) {
+	reader, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, newError("failed to open wheel: %v", err)
+	}
+	for _, file := range reader.File {
+		dir, name := path.Split(file.Name)
+		if name != "METADATA" || strings.Count(dir, "/") != 1 || !strings.HasSuffix(dir, ".dist-info/") {
+			continue
+		}
+		content, err := file.Open()
+		if err != nil {
+			return nil, newError("failed to open wheel metadata: %v", err)
+		}
+		defer content.Close()
+		data, err := readCoreMetadata(content)
+		if err != nil {
+			return nil, newError("failed to read wheel metadata: %v", err)
+		}
+		return data, nil
+	}
+	return nil, newError("wheel has no .dist-info/METADATA file")
+}
+
+// Reads the top level PKG-INFO file of an sdist. Formats without a standard library reader
+// return nil.
+func extractSdistMetadata(r io.ReaderAt, size int64, filename string) ([]byte, error) {
+	isPkgInfo := func(name string) bool {
+		dir, base := path.Split(strings.TrimPrefix(name, "./"))
+		return base == "PKG-INFO" && strings.Count(dir, "/") == 1
+	}
+	if strings.HasSuffix(filename, ".zip") {
+		reader, err := zip.NewReader(r, size)
+		if err != nil {
+			return nil, newError("failed to open sdist: %v", err)
+		}
+		for _, file := range reader.File {
+			if !isPkgInfo(file.Name) {
+				continue
+			}
+			content, err := file.Open()
+			if err != nil {
+				return nil, newError("failed to open sdist metadata: %v", err)
+			}
+			defer content.Close()
+			return readCoreMetadata(content)
+		}
+		return nil, newError("sdist has no PKG-INFO file")
+	}
+
+	var archive io.Reader = io.NewSectionReader(r, 0, size)
+	switch {
+	case strings.HasSuffix(filename, ".tar.gz"), strings.HasSuffix(filename, ".tgz"):
+		gzipReader, err := gzip.NewReader(archive)
+		if err != nil {
+			return nil, newError("failed to open sdist: %v", err)
+		}
+		defer gzipReader.Close()
+		archive = gzipReader
+	case strings.HasSuffix(filename, ".tar.bz2"):
+		archive = bzip2.NewReader(archive)
+	case strings.HasSuffix(filename, ".tar"):
+	default:
+		return nil, nil
+	}
+	reader := tar.NewReader(archive)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil, newError("sdist has no PKG-INFO file")
+		}
+		if err != nil {
+			return nil, newError("failed to read sdist: %v", err)
+		}
+		if header.Typeflag == tar.TypeReg && isPkgInfo(header.Name) {
+			return readCoreMetadata(reader)
+		}
+	}
+}
+
+// Reads the core metadata of a wheel or an sdist, nil for other distributions
+func extractDistributionMetadata(distribution *Distribution, r io.ReaderAt, size int64) ([]byte, error) {
+	switch distribution.FileType {
+	case "bdist_wheel":
+		return extractWheelMetadata(r, size)
+	case "sdist":
+		return extractSdistMetadata(r, size, distribution.Filename)
+	}
+	return nil, nil
+}
+
+// Parses the headers of a core metadata file, e.g. Name and Version
+func parseCoreMetadata(data []byte) (textproto.MIMEHeader, error) {
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(data))).ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, newError("failed to parse core metadata: %v", err)
+	}
+	return header, nil
+}
+
+// Opens a stored file for random access, downloading it to a temporary file if the storage
+// doesn't support it
+func openReaderAt(key string) (io.ReaderAt, func(), error) {
+	file, err := storage.Open(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if readerAt, ok := file.(io.ReaderAt); ok {
+		return readerAt, func() { file.Close() }, nil
+	}
+	defer file.Close()
+	tmp, err := os.CreateTemp("", tempFilePrefix+"*")
+	if err != nil {
+		return nil, nil, newError("failed to create temporary file: %v", err)
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	if _, err := io.Copy(tmp, file); err != nil {
+		cleanup()
+		return nil, nil, newError("failed to download file: %v", err)
+	}
+	return tmp, cleanup, nil
+}
+
+// Extracts the core metadata of a stored wheel next to it, recording its hash
+func saveCoreMetadata(versionKey string, record *FileRecord) error {
+	if !strings.HasSuffix(record.Filename, ".whl") {
+		return nil
+	}
+	readerAt, cleanup, err := openReaderAt(path.Join(versionKey, record.Filename))
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	metadata, err := extractWheelMetadata(readerAt, record.Size)
+	if err != nil {
+		return err
+	}
+	if err := storage.Put(coreMetadataKey(versionKey, record.Filename), bytes.NewReader(metadata)); err != nil {
+		return newError("failed to write core metadata: %v", err)
+	}
+	record.CoreMetadata = &FileDigests{SHA256: CalculateSHA256(metadata)}
+	return nil
+}
+
+// Gets the core metadata of a proxied file from the cache, or from its upstream next to the
+// file. If the sha256 listed by the upstream is given, metadata with another hash fails with
+// a 502 and isn't cached.
+func SaveCoreMetadataFromPyPI(u *Upstream, fileUrl *url.URL, repoData *ProjectInfo, expectedSHA256 string) error {
+	key := coreMetadataKey(packageVersionKey(repoData.Repo, repoData.Version), repoData.Filename)
+	_, err, _ := fetches.Do(key, func() (any, error) {
+		if _, err := storage.Stat(key); err == nil {
+			return nil, nil
+		}
+		metadataUrl := *fileUrl
+		metadataUrl.Path += coreMetadataSuffix
+		metadataUrl.RawPath = ""
+		what := "the core metadata of " + repoData.Filename
+		response, err := u.get(metadataUrl.String(), "", nil)
+		if err != nil {
+			return nil, u.requestError(what, err)
+		}
+		defer response.Body.Close()
+		if err := u.responseError(what, response); err != nil {
+			return nil, err
+		}
+		metadata, err := readCoreMetadata(response.Body)
+		if err != nil {
+			return nil, u.requestError(what, err)
+		}
+		if hash := CalculateSHA256(metadata); expectedSHA256 != "" && hash != expectedSHA256 {
+			return nil, &Error{
+				Message: fmt.Sprintf("The sha256 of %s is %s, the upstream lists %s.", what, hash, expectedSHA256),
+				Code:    http.StatusBadGateway,
+			}
+		}
+		if err := storage.Put(key, bytes.NewReader(metadata)); err != nil {
+			return nil, newError("failed to write core metadata: %v", err)
+		}
+		return nil, nil
+	})
+	return err
+}
+
+// Reports whether ".metadata" was appended to the proxy URL, removing it.
+// pip appends it after the query string.
+func isCoreMetadataRequest(u *url.URL) bool {
+	if strings.HasSuffix(u.RawQuery, coreMetadataSuffix) {
+		u.RawQuery = strings.TrimSuffix(u.RawQuery, coreMetadataSuffix)
+		return true
+	}
+	if strings.HasSuffix(u.Path, coreMetadataSuffix) {
+		u.Path = strings.TrimSuffix(u.Path, coreMetadataSuffix)
+		u.RawPath = ""
+		return true
+	}
+	return false
+}
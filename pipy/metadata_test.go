@@ -0,0 +1,90 @@
+package pipy
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testWheelMetadata = "Metadata-Version: 2.1\nName: my-package\nVersion: 1.0\nRequires-Dist: requests>=2\n"
+
+func newTestWheel(t *testing.T, files map[string]string) []byte {
+	buffer := &bytes.Buffer{}
+	writer := zip.NewWriter(buffer)
+	for name, content := range files {
+		file, err := writer.Create(name)
+		assert.NoError(t, err)
+		_, err = file.Write([]byte(content))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, writer.Close())
+	return buffer.Bytes()
+}
+
+func TestStoreWheelExtractsCoreMetadata(t *testing.T) {
+	useTestStorage(t)
+	wheel := newTestWheel(t, map[string]string{
+		"my_package/__init__.py":              "",
+		"my_package-1.0.dist-info/METADATA":   testWheelMetadata,
+		"my_package-1.0.dist-info/RECORD":     "",
+		"my_package/vendored.dist-info/OTHER": "",
+	})
+
+	record, err := storeFile("my-package", "1.0", "my_package-1.0-py3-none-any.whl", bytes.NewReader(wheel), FileDigests{})
+	assert.NoError(t, err)
+	assert.Equal(t, &FileDigests{SHA256: CalculateSHA256([]byte(testWheelMetadata))}, record.CoreMetadata)
+
+	file, err := GetFile("my-package", "1.0", "my_package-1.0-py3-none-any.whl.metadata")
+	assert.NoError(t, err)
+	defer file.Close()
+	content, _ := io.ReadAll(file)
+	assert.Equal(t, testWheelMetadata, string(content))
+
+	descriptor, err := GetPackageDescriptor("my-package")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.0/my_package-1.0-py3-none-any.whl", descriptor.Files[0].URL)
+	hash, ok := descriptor.Files[0].CoreMetadataHash()
+	assert.True(t, ok)
+	assert.Equal(t, "sha256="+CalculateSHA256([]byte(testWheelMetadata)), hash)
+}
+
+func TestExtractWheelMetadataIsLimited(t *testing.T) {
+	previous := maxCoreMetadataSize
+	maxCoreMetadataSize = 1024
+	t.Cleanup(func() { maxCoreMetadataSize = previous })
+	wheel := newTestWheel(t, map[string]string{
+		"my_package-1.0.dist-info/METADATA": testWheelMetadata + strings.Repeat("Classifier: A\n", 1000),
+	})
+
+	_, err := extractWheelMetadata(bytes.NewReader(wheel), int64(len(wheel)))
+	assert.ErrorContains(t, err, "larger than 1024 bytes")
+}
+
+func TestStoreFileWithoutCoreMetadata(t *testing.T) {
+	useTestStorage(t)
+
+	record, err := storeFile("my-package", "1.0", "my_package-1.0.tar.gz", bytes.NewReader([]byte("sdist")), FileDigests{})
+	assert.NoError(t, err)
+	assert.Nil(t, record.CoreMetadata)
+
+	record, err = storeFile("my-package", "1.0", "my_package-1.0-py3-none-any.whl", bytes.NewReader(newTestWheel(t, map[string]string{"my_package/__init__.py": ""})), FileDigests{})
+	assert.NoError(t, err)
+	assert.Nil(t, record.CoreMetadata)
+
+	_, err = GetFile("my-package", "1.0", "my_package-1.0.tar.gz.metadata")
+	assert.Equal(t, FileNotFound, err)
+}
+
+func TestIsCoreMetadataRequest(t *testing.T) {
+	proxyUrl, _ := url.Parse("/proxy/packages/ab/my_package-1.0-py3-none-any.whl?originalHost=pypi.org&originalScheme=https.metadata")
+	assert.True(t, isCoreMetadataRequest(proxyUrl))
+	assert.Equal(t, "originalHost=pypi.org&originalScheme=https", proxyUrl.RawQuery)
+
+	proxyUrl, _ = url.Parse("/proxy/packages/ab/my_package-1.0-py3-none-any.whl?originalHost=pypi.org&originalScheme=https")
+	assert.False(t, isCoreMetadataRequest(proxyUrl))
+}
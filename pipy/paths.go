@@ -0,0 +1,70 @@
+package pipy
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Checks a storage key: slash separated, relative, without "." or ".." segments, backslashes
+// or control characters. The empty key is the storage root.
+func validateKey(key string) error {
+	if key == "" {
+		return nil
+	}
+	if strings.HasPrefix(key, "/") || strings.ContainsAny(key, "\\\x00") {
+		return InvalidPath
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return InvalidPath
+		}
+		for _, c := range segment {
+			if c < 0x20 || c == 0x7f {
+				return InvalidPath
+			}
+		}
+	}
+	return nil
+}
+
+// Resolves a storage key to a file below root, rejecting keys that would escape it
+func resolveKey(root string, key string) (string, error) {
+	if err := validateKey(key); err != nil {
+		Logger.Warn("Rejected storage key", "key", key)
+		return "", err
+	}
+	resolved := filepath.Join(root, filepath.FromSlash(key))
+	relative, err := filepath.Rel(root, resolved)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		Logger.Warn("Rejected storage key", "key", key)
+		return "", InvalidPath
+	}
+	return resolved, nil
+}
+
+// Checks a project, version or file name taken from a request before it becomes part of a
+// key. Distribution names are printable ASCII, so separators, percent encoding, non-ASCII
+// look-alikes (e.g. fullwidth dots and slashes) and hidden names are rejected.
+func validatePathSegment(segment string) error {
+	if segment == "" || strings.HasPrefix(segment, ".") {
+		Logger.Warn("Rejected path segment", "segment", segment)
+		return InvalidPath
+	}
+	for _, c := range segment {
+		if c <= 0x20 || c >= 0x7f || strings.ContainsRune(`/\%:*?"<>|`, c) {
+			Logger.Warn("Rejected path segment", "segment", segment)
+			return InvalidPath
+		}
+	}
+	return nil
+}
+
+// Checks every segment of a request path
+func validatePathSegments(segments ...string) error {
+	for _, segment := range segments {
+		if err := validatePathSegment(segment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
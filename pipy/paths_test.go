@@ -0,0 +1,71 @@
+package pipy
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateKey(t *testing.T) {
+	for _, key := range []string{"", "numpy", "numpy/1.0/numpy-1.0.tar.gz", "numpy/1.0/.files/numpy-1.0.tar.gz.json"} {
+		assert.NoError(t, validateKey(key), key)
+	}
+	for _, key := range []string{"..", "../escape", "numpy/../../escape", "/etc/passwd", "numpy//1.0", "numpy/./1.0", "numpy/", `numpy\..\..\escape`, "numpy\x00.tar.gz"} {
+		assert.Equal(t, InvalidPath, validateKey(key), key)
+	}
+}
+
+func TestValidatePathSegment(t *testing.T) {
+	for _, segment := range []string{"numpy", "1.0rc1+local.1", "1!2.0", "numpy-1.0-py3-none-any.whl"} {
+		assert.NoError(t, validatePathSegment(segment), segment)
+	}
+	for _, segment := range []string{
+		"", ".", "..", ".files", "../etc", "..%2fetc", "%2e%2e", `..\etc`, "a/b",
+		"．．／etc", // fullwidth ../
+		"․․",     // one dot leaders
+		"..∕etc", // division slash
+		"numpy\x00", "numpy 1.0",
+	} {
+		assert.Equal(t, InvalidPath, validatePathSegment(segment), segment)
+	}
+}
+
+func TestStorageRejectsEscapingKeys(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "storage")
+	for name, storage := range map[string]Storage{"fs": NewFileSystemStorage(root), "s3": newTestS3Storage(t)} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, InvalidPath, storage.Put("../escape", bytes.NewReader([]byte("data"))))
+			_, err := storage.Open("numpy/../../escape")
+			assert.Equal(t, InvalidPath, err)
+			_, err = storage.Stat("/etc/passwd")
+			assert.Equal(t, InvalidPath, err)
+			_, err = storage.List("..")
+			assert.Equal(t, InvalidPath, err)
+			assert.Equal(t, InvalidPath, storage.Delete("../storage"))
+		})
+	}
+	_, err := os.Stat(filepath.Join(parent, "escape"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestGetFileRejectsTraversal(t *testing.T) {
+	useTestStorage(t)
+	_, err := storeFile("numpy", "1.0", "numpy-1.0.tar.gz", bytes.NewReader([]byte("sdist")), FileDigests{})
+	assert.NoError(t, err)
+
+	for _, segments := range [][3]string{
+		{"..", "numpy", "1.0"},
+		{"numpy", "..", "numpy-1.0.tar.gz"},
+		{"numpy", "1.0", "../1.0/numpy-1.0.tar.gz"},
+		{"numpy", "1.0", "..%2F..%2Findex.db"},
+		{"numpy", ".files", "numpy-1.0.tar.gz.json"},
+		{"numpy", "1.0", "．．／index.db"},
+	} {
+		_, err := GetFile(segments[0], segments[1], segments[2])
+		assert.Equal(t, InvalidPath, err, segments)
+	}
+}
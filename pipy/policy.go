@@ -0,0 +1,77 @@
+package pipy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"path"
+
+	"github.com/pfernandom/go-pypi/pep440"
+)
+
+// OverwritePolicy decides whether an upload may replace a file that already exists
+type OverwritePolicy string
+
+const (
+	// Files can never be replaced, so hashes pinned by installers stay valid
+	OverwriteImmutable OverwritePolicy = "immutable"
+	// Files can always be replaced
+	OverwriteAllow OverwritePolicy = "allow-overwrite"
+	// Only the files of development releases (e.g. 1.0.dev3) can be replaced
+	OverwriteAllowDevVersions OverwritePolicy = "allow-overwrite-dev-versions"
+)
+
+var overwritePolicy = OverwriteImmutable
+
+// Sets the overwrite policy of uploads, defaulting to immutable
+func SetupOverwritePolicy(policy OverwritePolicy) error {
+	switch policy {
+	case "":
+		policy = OverwriteImmutable
+	case OverwriteImmutable, OverwriteAllow, OverwriteAllowDevVersions:
+	default:
+		return newError("unknown overwrite policy %q, use %s, %s or %s", policy, OverwriteImmutable, OverwriteAllow, OverwriteAllowDevVersions)
+	}
+	overwritePolicy = policy
+	return nil
+}
+
+func (policy OverwritePolicy) allows(version string) bool {
+	switch policy {
+	case OverwriteAllow:
+		return true
+	case OverwriteAllowDevVersions:
+		v, err := pep440.Parse(version)
+		return err == nil && v.Dev != nil
+	}
+	return false
+}
+
+// Checks an upload against an existing file with the same name. Returns the record of the
+// stored file, nil if there is none, and whether the upload is identical to it, in which case
+// there is nothing to store, or a 409 Error if the policy forbids replacing it.
+func checkOverwrite(project string, version string, filename string, file io.ReaderAt, size int64) (*FileRecord, bool, error) {
+	versionKey := packageVersionKey(project, version)
+	if _, err := storage.Stat(path.Join(versionKey, filename)); err == FileNotFound {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	record, err := getFileRecord(versionKey, filename)
+	if err != nil {
+		return nil, false, err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(file, 0, size)); err != nil {
+		return nil, false, newError("failed to hash upload: %v", err)
+	}
+	if record.Hashes.SHA256 == hex.EncodeToString(hash.Sum(nil)) {
+		Logger.Info("Skipping upload of an identical file", "project", project, "version", version, "file", filename)
+		return record, true, nil
+	}
+	if !overwritePolicy.allows(version) {
+		return nil, false, newErrorWithCode(409, "File already exists (%q), with different contents. Files cannot be replaced, upload a new version instead.", filename)
+	}
+	Logger.Info("Overwriting file", "project", project, "version", version, "file", filename, "policy", overwritePolicy)
+	return record, false, nil
+}
@@ -0,0 +1,68 @@
+package pipy
+
+import "fmt"
+
+// Normalized project names or globs (e.g. "acme-*") that are never proxied, so a package
+// published upstream under an internal name can't be installed in its place
+var reservedProjects []string
+
+// Whether projects with uploaded files are never mixed with files from the upstreams
+var isolateLocalProjects bool
+
+// Sets the dependency confusion protection of the proxy
+func SetupProxyProtection(reserved []string, isolateLocal bool) error {
+	reserved, err := normalizeProjectPatterns(reserved, "reserved project pattern")
+	if err != nil {
+		return err
+	}
+	reservedProjects = reserved
+	isolateLocalProjects = isolateLocal
+	return nil
+}
+
+// Reports whether the project matches a reserved name or glob
+func isReserved(project string) bool {
+	return matchProject(reservedProjects, project)
+}
+
+// Reports whether the project has uploaded files, including through another replica. Files
+// proxied before upstreams were recorded on them count as uploaded.
+func isHostedLocally(project string) (bool, error) {
+	releases, err := indexReleases(project)
+	if err == RepoNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, release := range releases {
+		for _, record := range release.Files {
+			if record.Upstream == "" {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// Checks whether the project may be proxied, logging every blocked attempt. Projects with
+// uploaded files are only proxied if they are merged, and never when isolated. Returns a 403
+// Error if it can't.
+func checkProxyAllowed(project string, what string) error {
+	if isReserved(project) {
+		Logger.Warn("Blocked proxying of a reserved project", "project", project, "request", what)
+		return &Error{Message: fmt.Sprintf("Project %q is reserved and is never proxied.", project), Code: 403}
+	}
+	if !isolateLocalProjects && matchProject(mergedProjects, project) {
+		return nil
+	}
+	local, err := isHostedLocally(project)
+	if err != nil {
+		return err
+	}
+	if local {
+		Logger.Warn("Blocked proxying of a locally hosted project", "project", project, "request", what)
+		return &Error{Message: fmt.Sprintf("Project %q is hosted locally and is never proxied.", project), Code: 403}
+	}
+	return nil
+}
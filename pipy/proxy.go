@@ -5,55 +5,157 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"path"
+	"slices"
 	"strings"
+
+	"github.com/pfernandom/go-pypi/pep440"
 )
 
-var piPyUrl = "https://pypi.org/simple"
+// Query parameter of proxy URLs naming the upstream a file came from
+var upstreamQueryParam = "upstream"
 
-func HandleProxyGetDescriptor(filename string, w http.ResponseWriter, r *http.Request) {
-	Logger.Debug("Proxying file from PyPI", "filename", filename)
-	filename = strings.TrimPrefix(filename, "/")
+// Origin of the files hosted locally in merged descriptors
+var localOrigin = "local"
 
-	Logger.Debug("Proxying file from PyPI", "url", fmt.Sprintf("%s/%s/", piPyUrl, filename))
+// Normalized project names or globs whose local files are merged with the upstream ones
+var mergedProjects []string
 
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/%s/", piPyUrl, filename), nil)
+// Sets the projects whose descriptors merge local and upstream files
+func SetupMergedProjects(patterns []string) error {
+	patterns, err := normalizeProjectPatterns(patterns, "merged project pattern")
 	if err != nil {
-		Logger.Error("Failed to get file from PyPI", "error", err)
-		http.Error(w, fmt.Sprintf("Failed to get file from PyPI: %v", err), http.StatusInternalServerError)
-		return
+		return err
 	}
-	req.Header.Set("Accept", "application/vnd.pypi.simple.v1+json")
+	mergedProjects = patterns
+	return nil
+}
 
-	client := &http.Client{}
-	response, err := client.Do(req)
+// Adds the upstream files of a merged project to its local descriptor. Local files win on
+// a filename collision. If the upstreams fail, only the local files are served.
+func MergeUpstreamFiles(local *Response) *Response {
+	if !matchProject(mergedProjects, local.Name) {
+		return local
+	}
+	upstream, err := GetProxyDescriptor(local.Name)
 	if err != nil {
-		Logger.Error("Failed to get file from PyPI", "error", err)
-		http.Error(w, fmt.Sprintf("Failed to get file from PyPI: %v", err), http.StatusInternalServerError)
-		return
+		if err != RepoNotFound {
+			Logger.Warn("Serving only the local files of a merged project", "project", local.Name, "error", err)
+		}
+		return local
+	}
+	merged := &Response{Meta: local.Meta, Name: local.Name, Versions: slices.Clone(local.Versions), Files: []File{}, Stale: upstream.Stale}
+	seen := map[string]bool{}
+	for _, file := range local.Files {
+		seen[file.Filename] = true
+		if file.Origin == "" {
+			file.Origin = localOrigin
+		}
+		merged.Files = append(merged.Files, file)
+	}
+	for _, file := range upstream.Files {
+		if !seen[file.Filename] {
+			merged.Files = append(merged.Files, file)
+		}
+	}
+	for _, version := range upstream.Versions {
+		if !slices.Contains(merged.Versions, version) {
+			merged.Versions = append(merged.Versions, version)
+		}
 	}
-	defer response.Body.Close()
+	pep440.Sort(merged.Versions)
+	return merged
+}
+
+// Gets the package descriptor from the upstreams serving the project, pointing the file URLs
+// to the proxy. The files of all the upstreams having the project are merged, on a filename
+// collision the upstream with the higher priority wins. Projects that can't be proxied
+// aren't found. If the upstreams can't be reached, the files downloaded before are served.
+func GetProxyDescriptor(filename string) (*Response, error) {
+	project := strings.TrimPrefix(filename, "/")
+	if err := checkProxyAllowed(project, "descriptor"); err != nil {
+		if pipyErr, ok := err.(*Error); ok && pipyErr.Code == 403 {
+			return nil, RepoNotFound
+		}
+		return nil, err
+	}
+	var merged *Response
+	var lastErr error
+	seen := map[string]bool{}
+	for _, u := range upstreamsFor(project) {
+		responseData, err := u.getDescriptor(project)
+		if err == RepoNotFound {
+			continue
+		}
+		if err != nil {
+			Logger.Warn("Failed to get descriptor from upstream", "upstream", u.Name, "project", project, "error", err)
+			lastErr = err
+			continue
+		}
+		if merged == nil {
+			merged = &Response{Name: responseData.Name, Versions: []string{}, Files: []File{}}
+		}
+		merged.Stale = merged.Stale || responseData.Stale
+		for _, version := range responseData.Versions {
+			if !slices.Contains(merged.Versions, version) {
+				merged.Versions = append(merged.Versions, version)
+			}
+		}
+		for _, file := range responseData.Files {
+			if seen[file.Filename] {
+				continue
+			}
+			seen[file.Filename] = true
+			merged.Files = append(merged.Files, file)
+		}
+	}
+	if merged == nil {
+		if lastErr == nil {
+			return nil, RepoNotFound
+		}
+		// Failing open with the files downloaded before
+		cached, err := indexDescriptor(project)
+		if err != nil {
+			return nil, lastErr
+		}
+		Logger.Warn("Serving the cached files of a project, upstreams are unreachable", "project", project)
+		cached.Stale = true
+		return cached, nil
+	}
+	merged.Meta = Meta{ApiVersion: ApiVersion}
+	// Files of the upstreams that failed may be missing
+	merged.Stale = merged.Stale || lastErr != nil
+	pep440.Sort(merged.Versions)
+	return merged, nil
+}
+
+// Reads the descriptor of a project from an upstream response, pointing the file URLs to
+// the proxy
+func (u *Upstream) readDescriptor(project string, response *http.Response) (*Response, error) {
+	projectUrl := u.projectUrl(project)
+	Logger.Debug("Proxying descriptor from upstream", "upstream", u.Name, "url", projectUrl)
 
 	body, err := io.ReadAll(response.Body)
 	if err != nil {
-		Logger.Error("Failed to read response body", "error", err)
-		http.Error(w, fmt.Sprintf("Failed to read response body: %v", err), http.StatusInternalServerError)
-		return
+		return nil, newError("failed to read response body: %v", err)
 	}
 
 	var responseData Response
 	err = json.Unmarshal(body, &responseData)
 	if err != nil {
-		Logger.Error("Failed to unmarshal response", "error", err)
 		jsonBody := TryPrettyPrintJson(body)
 		Logger.Debug("Response body", "body", jsonBody)
-		http.Error(w, fmt.Sprintf("Failed to unmarshal response: %v", err), http.StatusInternalServerError)
-		return
+		return nil, newError("failed to unmarshal response: %v", err)
 	}
 
 	updatedFiles := []File{}
 	for _, file := range responseData.Files {
-
-		fileUrl, err := file.GetUrl()
+		// Relative file URLs, e.g. from another go-pypi, are relative to the project page
+		fileUrl, err := url.Parse(projectUrl)
+		if err == nil {
+			fileUrl, err = fileUrl.Parse(file.URL)
+		}
 		if err != nil {
 			Logger.Error("Proxied response has invalid URL", "error", err)
 			continue
@@ -63,18 +165,22 @@ func HandleProxyGetDescriptor(filename string, w http.ResponseWriter, r *http.Re
 			Logger.Warn("Failed to encode URL", "error", err)
 			continue
 		}
+		query := newUrl.Query()
+		query.Set(upstreamQueryParam, u.Name)
+		newUrl.RawQuery = query.Encode()
 		file.URL = newUrl.String()
+		file.Origin = u.Name
 
 		updatedFiles = append(updatedFiles, file)
 	}
 	responseData.Files = updatedFiles
-	w.Header().Set("Content-Type", "application/vnd.pypi.simple.v1+json")
-	json.NewEncoder(w).Encode(responseData)
+	return &responseData, nil
 }
 
-// Requests the file from PyPI and saves it to the local storage
+// Requests the file from the upstream listing it and saves it to the local storage
 func HandleProxyFileDownload(w http.ResponseWriter, r *http.Request, next http.Handler) error {
-	decodedUrl, err := DecodeUrlFromUrlSafeBase64("/proxy", *r.URL)
+	coreMetadataRequest := isCoreMetadataRequest(r.URL)
+	decodedUrl, upstreamName, err := decodeProxyUrl(*r.URL)
 	if err != nil {
 		Logger.Error("Failed to decode URL", "error", err)
 		return fmt.Errorf("failed to decode URL: %v", err)
@@ -83,14 +189,110 @@ func HandleProxyFileDownload(w http.ResponseWriter, r *http.Request, next http.H
 	repoData, err := ParseProjectData(decodedUrl.String())
 	if err != nil {
 		Logger.Error("Failed to parse repo data", "error", err)
-		return fmt.Errorf("failed to parse repo data: %v", err)
+		return newErrorWithCode(400, "Invalid distribution filename. %v", err)
+	}
+	if err := validatePathSegments(repoData.Repo, repoData.Version, repoData.Filename); err != nil {
+		return err
+	}
+	if err := checkProxyAllowed(repoData.Repo, repoData.Filename); err != nil {
+		return err
+	}
+	versionKey := packageVersionKey(repoData.Repo, repoData.Version)
+	key := path.Join(versionKey, repoData.Filename)
+	if coreMetadataRequest {
+		key = coreMetadataKey(versionKey, repoData.Filename)
 	}
-	err = SaveFileFromPyPI(decodedUrl, repoData.Filename, &repoData)
+	u, file, err := listedFile(upstreamName, decodedUrl, &repoData)
 	if err != nil {
-		Logger.Error("Failed to save file", "error", err)
-		return fmt.Errorf("failed to save file: %v", err)
+		// Files downloaded before are still served, e.g. when the upstreams are down
+		if _, statErr := storage.Stat(key); statErr != nil {
+			return err
+		}
+		Logger.Warn("Serving stored file not listed by the upstreams", "file", key, "error", err)
+		r.URL.Path = "/" + key
+		next.ServeHTTP(w, r)
+		return nil
+	}
+	if coreMetadataRequest {
+		expectedSHA256, _ := file.CoreMetadataHash()
+		err = SaveCoreMetadataFromPyPI(u, decodedUrl, &repoData, strings.ToLower(strings.TrimPrefix(expectedSHA256, "sha256=")))
+		if err != nil {
+			return fmt.Errorf("failed to save core metadata: %w", err)
+		}
+		r.URL.Path = "/" + key
+		next.ServeHTTP(w, r)
+		return nil
 	}
-	r.URL.Path = fmt.Sprintf("/%s/%s/%s", repoData.Repo, repoData.Version, repoData.Filename)
+	// Streamed while it is downloaded, or served from the storage once it is there
+	err = serveDownload(w, u, decodedUrl, &repoData, strings.ToLower(file.Hashes.SHA256))
+	if err != FileNotFound {
+		if err != nil {
+			Logger.Error("Failed to download file", "error", err)
+			return fmt.Errorf("failed to download file: %w", err)
+		}
+		return nil
+	}
+	r.URL.Path = "/" + key
 	next.ServeHTTP(w, r)
 	return nil
 }
+
+// Decodes a proxy URL into the URL of the file upstream and the name of the upstream listing it
+func decodeProxyUrl(proxyUrl url.URL) (*url.URL, string, error) {
+	query := proxyUrl.Query()
+	upstreamName := query.Get(upstreamQueryParam)
+	query.Del(upstreamQueryParam)
+	proxyUrl.RawQuery = query.Encode()
+	proxyUrl.Fragment = ""
+	fileUrl, err := DecodeUrlFromUrlSafeBase64("/proxy", proxyUrl)
+	return fileUrl, upstreamName, err
+}
+
+// Gets the upstream listing a proxied file, and the file as listed in its descriptor. Only the
+// files listed by the upstreams serving their project are downloaded, so a proxy URL can't
+// fetch from other hosts or store a file under another project.
+func listedFile(upstreamName string, fileUrl *url.URL, repoData *ProjectInfo) (*Upstream, *File, error) {
+	var lastErr error
+	for _, u := range upstreamsFor(repoData.Repo) {
+		if upstreamName != "" && u.Name != upstreamName {
+			continue
+		}
+		descriptor, err := u.getDescriptor(repoData.Repo)
+		if err != nil {
+			if err != RepoNotFound {
+				lastErr = err
+			}
+			continue
+		}
+		for _, file := range descriptor.Files {
+			if file.Filename != repoData.Filename {
+				continue
+			}
+			listedUrl, err := url.Parse(file.URL)
+			if err != nil {
+				continue
+			}
+			if decodedUrl, _, err := decodeProxyUrl(*listedUrl); err == nil && decodedUrl.String() == fileUrl.String() {
+				return u, &file, nil
+			}
+		}
+	}
+	if lastErr != nil {
+		return nil, nil, lastErr
+	}
+	return nil, nil, newErrorWithCode(404, "%s isn't listed by the upstreams of %s.", repoData.Filename, repoData.Repo)
+}
+
+// Gets a proxied file from the cached descriptor of its upstream, nil if it isn't listed
+func cachedUpstreamFile(u *Upstream, repoData *ProjectInfo) *File {
+	cached, err := index.GetDescriptor(u.Name, repoData.Repo)
+	if err != nil {
+		return nil
+	}
+	for _, file := range cached.Response.Files {
+		if file.Filename == repoData.Filename {
+			return &file
+		}
+	}
+	return nil
+}
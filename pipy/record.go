@@ -0,0 +1,196 @@
+package pipy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"path"
+	"sync"
+	"time"
+)
+
+// Directory next to the distribution files holding their records
+var fileRecordsDir = ".files"
+
+// Metadata of a stored distribution file, computed once when the file is written
+type FileRecord struct {
+	Filename   string      `json:"filename"`
+	Size       int64       `json:"size"`
+	UploadTime time.Time   `json:"upload-time"`
+	Hashes     FileDigests `json:"hashes"`
+	// Upload metadata describing this file rather than the release
+	FileType       string `json:"filetype,omitempty"`
+	PyVersion      string `json:"pyversion,omitempty"`
+	RequiresPython string `json:"requires-python,omitempty"`
+	Uploader       string `json:"uploader,omitempty"`
+	// Name of the upstream a proxied file was downloaded from
+	Upstream string `json:"upstream,omitempty"`
+	// Hash of the PEP 658 core metadata file, if there is one
+	CoreMetadata *FileDigests `json:"core-metadata,omitempty"`
+	// PEP 592 yanked state
+	Yanked       bool   `json:"yanked,omitempty"`
+	YankedReason string `json:"yanked-reason,omitempty"`
+}
+
+// Locks of the storage keys being written, so checking and writing a file isn't interleaved
+// with another write of the same key
+var keyLocks = struct {
+	sync.Mutex
+	locks map[string]*keyLock
+}{locks: map[string]*keyLock{}}
+
+type keyLock struct {
+	sync.Mutex
+	// Holders and waiters, the lock is dropped after the last
+	refs int
+}
+
+// Locks a storage key, returning the function unlocking it
+func lockKey(key string) func() {
+	keyLocks.Lock()
+	lock, ok := keyLocks.locks[key]
+	if !ok {
+		lock = &keyLock{}
+		keyLocks.locks[key] = lock
+	}
+	lock.refs++
+	keyLocks.Unlock()
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		keyLocks.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(keyLocks.locks, key)
+		}
+		keyLocks.Unlock()
+	}
+}
+
+func fileRecordKey(versionKey string, filename string) string {
+	return path.Join(versionKey, fileRecordsDir, filename+".json")
+}
+
+// Stores the file, hashing it as it is written, and saves and indexes its record.
+// If expected digests are given and don't match, nothing is stored.
+func storeFile(project string, version string, filename string, r io.Reader, expected FileDigests) (*FileRecord, error) {
+	return storeFileWithRecord(project, version, &FileRecord{Filename: filename}, r, expected)
+}
+
+// Stores a file like storeFile, keeping the upload metadata already set on record, e.g. the
+// upload time of a proxied file
+func storeFileWithRecord(project string, version string, record *FileRecord, r io.Reader, expected FileDigests) (*FileRecord, error) {
+	version = releaseVersion(project, version)
+	versionKey := packageVersionKey(project, version)
+	reader := newDigestReader(r, expected)
+	if err := storage.Put(path.Join(versionKey, record.Filename), reader); err != nil {
+		if pipyErr, ok := err.(*Error); ok {
+			return nil, pipyErr
+		}
+		return nil, newError("failed to copy file: %v", err)
+	}
+	record.Size = reader.size
+	if record.UploadTime.IsZero() {
+		record.UploadTime = time.Now().UTC()
+	}
+	record.Hashes = reader.Digests()
+	if record.FileType == "" {
+		record.FileType = distributionFileType(record.Filename)
+	}
+	if err := saveCoreMetadata(versionKey, record); err != nil {
+		Logger.Warn("Failed to extract core metadata", "file", record.Filename, "error", err)
+	}
+	if err := saveFileRecord(versionKey, record); err != nil {
+		return nil, err
+	}
+	if err := index.PutFile(project, version, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// Deletes a stored file with its record and core metadata, and removes it from the index
+func deleteStoredFile(project string, version string, filename string) error {
+	versionKey := packageVersionKey(project, version)
+	for _, key := range []string{
+		path.Join(versionKey, filename),
+		fileRecordKey(versionKey, filename),
+		coreMetadataKey(versionKey, filename),
+	} {
+		if err := storage.Delete(key); err != nil {
+			return newError("failed to delete %s: %v", key, err)
+		}
+	}
+	return index.DeleteFile(project, path.Base(versionKey), filename)
+}
+
+// Gets the upload filetype of a distribution from its filename, "" if unknown
+func distributionFileType(filename string) string {
+	distribution, err := ParseDistributionFilename(filename)
+	if err != nil {
+		return ""
+	}
+	return distribution.FileType
+}
+
+func saveFileRecord(versionKey string, record *FileRecord) error {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return newError("failed to marshal file record: %v", err)
+	}
+	if err := storage.Put(fileRecordKey(versionKey, record.Filename), bytes.NewReader(data)); err != nil {
+		return newError("failed to write file record: %v", err)
+	}
+	return nil
+}
+
+// Gets the record of a stored file. Files stored before records existed are hashed once and
+// their record saved.
+func getFileRecord(versionKey string, filename string) (*FileRecord, error) {
+	file, err := storage.Open(fileRecordKey(versionKey, filename))
+	if err == nil {
+		defer file.Close()
+		var record FileRecord
+		if err := json.NewDecoder(file).Decode(&record); err != nil {
+			return nil, newError("failed to unmarshal file record: %v", err)
+		}
+		return &record, nil
+	}
+	if err != FileNotFound {
+		return nil, newError("failed to open file record: %v", err)
+	}
+
+	info, err := storage.Stat(path.Join(versionKey, filename))
+	if err != nil {
+		return nil, newError("failed to stat file: %v", err)
+	}
+	content, err := storage.Open(path.Join(versionKey, filename))
+	if err != nil {
+		return nil, newError("failed to open file: %v", err)
+	}
+	defer content.Close()
+	reader := newDigestReader(content, FileDigests{})
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return nil, newError("failed to hash file: %v", err)
+	}
+	record := &FileRecord{
+		Filename:   filename,
+		Size:       reader.size,
+		UploadTime: info.ModTime.UTC(),
+		Hashes:     reader.Digests(),
+		FileType:   distributionFileType(filename),
+	}
+	// Releases uploaded before per-file records kept the metadata of their last file
+	if upload, err := readUploadRequestData(versionKey); err == nil && upload.Sha256Digest == record.Hashes.SHA256 {
+		record.FileType = upload.FileType
+		record.PyVersion = upload.Pyversion
+		record.RequiresPython = upload.RequiresPython
+	}
+	if err := saveCoreMetadata(versionKey, record); err != nil {
+		Logger.Warn("Failed to extract core metadata", "file", filename, "error", err)
+	}
+	if err := saveFileRecord(versionKey, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
@@ -0,0 +1,130 @@
+package pipy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func useTestStorage(t *testing.T) Storage {
+	previousStorage, previousIndex := storage, index
+	SetupStorage(NewFileSystemStorage(t.TempDir()))
+	i, err := OpenIndex(filepath.Join(t.TempDir(), "index.db"))
+	assert.NoError(t, err)
+	index = i
+	t.Cleanup(func() {
+		i.Close()
+		storage, index = previousStorage, previousIndex
+	})
+	return storage
+}
+
+func TestStoreFileSavesRecord(t *testing.T) {
+	s := useTestStorage(t)
+
+	record, err := storeFile("my-package", "1.0", "my_package-1.0.tar.gz", strings.NewReader("sdist"), FileDigests{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), record.Size)
+	assert.Equal(t, CalculateSHA256([]byte("sdist")), record.Hashes.SHA256)
+	assert.Equal(t, "1c48b0a6a9777b2d3079bce9434b7d5b", record.Hashes.MD5)
+	assert.Len(t, record.Hashes.Blake2b256, 64)
+	assert.False(t, record.UploadTime.IsZero())
+
+	file, err := s.Open("my-package/1.0/.files/my_package-1.0.tar.gz.json")
+	assert.NoError(t, err)
+	defer file.Close()
+	var saved FileRecord
+	assert.NoError(t, json.NewDecoder(file).Decode(&saved))
+	assert.Equal(t, record.Hashes, saved.Hashes)
+}
+
+func TestGetPackageDescriptorUsesFileRecords(t *testing.T) {
+	s := useTestStorage(t)
+
+	_, err := storeFile("my-package", "1.0", "my_package-1.0.tar.gz", strings.NewReader("sdist"), FileDigests{})
+	assert.NoError(t, err)
+	// The stored hash is served as is, the file is not read again
+	assert.NoError(t, saveFileRecord("my-package/1.0", &FileRecord{
+		Filename: "my_package-1.0.tar.gz",
+		Hashes:   FileDigests{SHA256: "recorded"},
+	}))
+	// Files stored without a record are hashed once
+	assert.NoError(t, s.Put("my-package/1.0/my_package-1.0-py3-none-any.whl", strings.NewReader("wheel")))
+	assert.NoError(t, Reindex())
+
+	descriptor, err := GetPackageDescriptor("my-package")
+	assert.NoError(t, err)
+	hashes := map[string]string{}
+	for _, file := range descriptor.Files {
+		hashes[file.Filename] = file.Hashes.SHA256
+	}
+	assert.Equal(t, map[string]string{
+		"my_package-1.0.tar.gz":           "recorded",
+		"my_package-1.0-py3-none-any.whl": CalculateSHA256([]byte("wheel")),
+	}, hashes)
+
+	file, err := s.Open("my-package/1.0/.files/my_package-1.0-py3-none-any.whl.json")
+	assert.NoError(t, err)
+	defer file.Close()
+	data, _ := io.ReadAll(file)
+	assert.Contains(t, string(data), CalculateSHA256([]byte("wheel")))
+}
+
+func TestFileRecordBackfillUsesLegacyRequestData(t *testing.T) {
+	s := useTestStorage(t)
+
+	// Before per-file records, request.json kept the metadata of the last uploaded file
+	assert.NoError(t, s.Put("my-package/1.0/my_package-1.0-py3-none-any.whl", strings.NewReader("wheel")))
+	assert.NoError(t, s.Put("my-package/1.0/my_package-1.0.tar.gz", strings.NewReader("sdist")))
+	request, err := json.Marshal(&UploadRequestForm{
+		Name:           "my-package",
+		Version:        "1.0",
+		FileType:       "bdist_wheel",
+		Pyversion:      "py3",
+		RequiresPython: ">=3.8",
+		Sha256Digest:   CalculateSHA256([]byte("wheel")),
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, s.Put("my-package/1.0/request.json", bytes.NewReader(request)))
+
+	wheel, err := getFileRecord("my-package/1.0", "my_package-1.0-py3-none-any.whl")
+	assert.NoError(t, err)
+	assert.Equal(t, "bdist_wheel", wheel.FileType)
+	assert.Equal(t, "py3", wheel.PyVersion)
+	assert.Equal(t, ">=3.8", wheel.RequiresPython)
+
+	sdist, err := getFileRecord("my-package/1.0", "my_package-1.0.tar.gz")
+	assert.NoError(t, err)
+	assert.Equal(t, "sdist", sdist.FileType)
+	assert.Empty(t, sdist.PyVersion)
+}
+
+func TestGetPackageDescriptorPEP700Fields(t *testing.T) {
+	useTestStorage(t)
+	for _, version := range []string{"1.10", "1.9", "1.0rc1", "1.0"} {
+		_, err := storeFile("my-package", version, "my_package-"+version+".tar.gz", strings.NewReader("sdist"), FileDigests{})
+		assert.NoError(t, err)
+	}
+
+	descriptor, err := GetPackageDescriptor("my-package")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.1", descriptor.Meta.ApiVersion)
+	assert.Equal(t, []string{"1.0rc1", "1.0", "1.9", "1.10"}, descriptor.Versions)
+	for _, file := range descriptor.Files {
+		assert.Equal(t, int64(5), *file.Size)
+		uploadTime, err := time.Parse(UploadTimeFormat, *file.UploadTime)
+		assert.NoError(t, err)
+		assert.WithinDuration(t, time.Now(), uploadTime, time.Minute)
+	}
+
+	data, err := json.Marshal(descriptor)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"meta":{"api-version":"1.1"}`)
+	assert.Contains(t, string(data), `"size":5,"upload-time":"`)
+}
@@ -4,32 +4,172 @@ import (
 	"net/url"
 	"regexp"
 	"strings"
+
+	"github.com/pfernandom/go-pypi/pep440"
 )
 
+// Upload request as sent by twine to the legacy upload API, with the core metadata 2.x fields
 type UploadRequestForm struct {
-	Name                   string `form:"name"`
-	Version                string `form:"version"`
-	Sha256Digest           string `form:"sha256_digest"`
-	ProtocolVersion        string `form:"protocol_version"`
-	MetadataVersion        string `form:"metadata_version"`
-	FileType               string `form:"filetype"`
-	Pyversion              string `form:"pyversion"`
-	AuthorEmail            string `form:"author_email"`
-	DescriptionContentType string `form:"description_content_type"`
-	Summary                string `form:"summary"`
-	RequiresPython         string `form:"requires_python"`
+	Action                 string   `form:":action"`
+	Name                   string   `form:"name"`
+	Version                string   `form:"version"`
+	Md5Digest              string   `form:"md5_digest"`
+	Sha256Digest           string   `form:"sha256_digest"`
+	Blake2256Digest        string   `form:"blake2_256_digest"`
+	ProtocolVersion        string   `form:"protocol_version"`
+	MetadataVersion        string   `form:"metadata_version"`
+	FileType               string   `form:"filetype"`
+	Pyversion              string   `form:"pyversion"`
+	Comment                string   `form:"comment"`
+	Summary                string   `form:"summary"`
+	Description            string   `form:"description"`
+	DescriptionContentType string   `form:"description_content_type"`
+	Keywords               string   `form:"keywords"`
+	HomePage               string   `form:"home_page"`
+	DownloadUrl            string   `form:"download_url"`
+	Author                 string   `form:"author"`
+	AuthorEmail            string   `form:"author_email"`
+	Maintainer             string   `form:"maintainer"`
+	MaintainerEmail        string   `form:"maintainer_email"`
+	License                string   `form:"license"`
+	LicenseExpression      string   `form:"license_expression"`
+	LicenseFiles           []string `form:"license_file"`
+	Classifiers            []string `form:"classifiers"`
+	Platforms              []string `form:"platform"`
+	SupportedPlatforms     []string `form:"supported_platform"`
+	RequiresPython         string   `form:"requires_python"`
+	RequiresDist           []string `form:"requires_dist"`
+	RequiresExternal       []string `form:"requires_external"`
+	ProvidesDist           []string `form:"provides_dist"`
+	ObsoletesDist          []string `form:"obsoletes_dist"`
+	ProvidesExtra          []string `form:"provides_extra"`
+	ProjectUrls            []string `form:"project_urls"`
+	Dynamic                []string `form:"dynamic"`
+	Requires               []string `form:"requires"`
+	Provides               []string `form:"provides"`
+	Obsoletes              []string `form:"obsoletes"`
+}
+
+var validFileTypes = map[string]bool{
+	"sdist":         true,
+	"bdist_wheel":   true,
+	"bdist_egg":     true,
+	"bdist_wininst": true,
+	"bdist_rpm":     true,
+	"bdist_dumb":    true,
+	"bdist_msi":     true,
+}
+
+var validMetadataVersions = map[string]bool{
+	"1.0": true, "1.1": true, "1.2": true, "2.0": true, "2.1": true, "2.2": true, "2.3": true, "2.4": true,
 }
 
+var hexDigestRegex = regexp.MustCompile("^[0-9a-f]+$")
+var normalizedProjectNameRegex = regexp.MustCompile("^[a-z0-9]([a-z0-9-]*[a-z0-9])?$")
+
+// Parses and validates the upload form, returning a 400 Error for invalid metadata
 func ParseUploadRequestFrom(r *url.Values) (*UploadRequestForm, error) {
-	return &UploadRequestForm{
-		Name:            NormalizeProjectName(r.Get("name")),
-		Version:         r.Get("version"),
-		Sha256Digest:    r.Get("sha256_digest"),
-		ProtocolVersion: r.Get("protocol_version"),
-		MetadataVersion: r.Get("metadata_version"),
-		FileType:        r.Get("filetype"),
-		Pyversion:       r.Get("pyversion"),
-	}, nil
+	form := &UploadRequestForm{
+		Action:                 r.Get(":action"),
+		Name:                   NormalizeProjectName(r.Get("name")),
+		Version:                r.Get("version"),
+		Md5Digest:              strings.ToLower(r.Get("md5_digest")),
+		Sha256Digest:           strings.ToLower(r.Get("sha256_digest")),
+		Blake2256Digest:        strings.ToLower(r.Get("blake2_256_digest")),
+		ProtocolVersion:        r.Get("protocol_version"),
+		MetadataVersion:        r.Get("metadata_version"),
+		FileType:               r.Get("filetype"),
+		Pyversion:              r.Get("pyversion"),
+		Comment:                r.Get("comment"),
+		Summary:                r.Get("summary"),
+		Description:            r.Get("description"),
+		DescriptionContentType: r.Get("description_content_type"),
+		Keywords:               r.Get("keywords"),
+		HomePage:               r.Get("home_page"),
+		DownloadUrl:            r.Get("download_url"),
+		Author:                 r.Get("author"),
+		AuthorEmail:            r.Get("author_email"),
+		Maintainer:             r.Get("maintainer"),
+		MaintainerEmail:        r.Get("maintainer_email"),
+		License:                r.Get("license"),
+		LicenseExpression:      r.Get("license_expression"),
+		LicenseFiles:           formValues(r, "license_file"),
+		Classifiers:            formValues(r, "classifiers"),
+		Platforms:              formValues(r, "platform"),
+		SupportedPlatforms:     formValues(r, "supported_platform"),
+		RequiresPython:         r.Get("requires_python"),
+		RequiresDist:           formValues(r, "requires_dist"),
+		RequiresExternal:       formValues(r, "requires_external"),
+		ProvidesDist:           formValues(r, "provides_dist"),
+		ObsoletesDist:          formValues(r, "obsoletes_dist"),
+		ProvidesExtra:          formValues(r, "provides_extra"),
+		ProjectUrls:            formValues(r, "project_urls"),
+		Dynamic:                formValues(r, "dynamic"),
+		Requires:               formValues(r, "requires"),
+		Provides:               formValues(r, "provides"),
+		Obsoletes:              formValues(r, "obsoletes"),
+	}
+	if err := form.validate(); err != nil {
+		return nil, err
+	}
+	return form, nil
+}
+
+func (form *UploadRequestForm) validate() error {
+	if form.Action != "" && form.Action != "file_upload" {
+		return newErrorWithCode(400, "Unknown action: %s", form.Action)
+	}
+	if form.ProtocolVersion != "" && form.ProtocolVersion != "1" {
+		return newErrorWithCode(400, "Unknown protocol version: %s", form.ProtocolVersion)
+	}
+	if form.Name == "" {
+		return newErrorWithCode(400, "Invalid value for name. Error: This field is required.")
+	}
+	if !normalizedProjectNameRegex.MatchString(form.Name) {
+		return newErrorWithCode(400, "Invalid value for name. Error: Start and end with a letter or numeral containing only ASCII numeric and '.', '_' and '-'.")
+	}
+	if form.Version == "" {
+		return newErrorWithCode(400, "Invalid value for version. Error: This field is required.")
+	}
+	version, err := pep440.Normalize(form.Version)
+	if err != nil {
+		return newErrorWithCode(400, "Invalid value for version. Error: %q is not a valid PEP 440 version.", form.Version)
+	}
+	form.Version = version
+	if _, err := pep440.ParseSpecifiers(form.RequiresPython); err != nil {
+		return newErrorWithCode(400, "Invalid value for requires_python. Error: %v", err)
+	}
+	if form.FileType != "" && !validFileTypes[form.FileType] {
+		return newErrorWithCode(400, "Invalid value for filetype. Error: Use a known file type.")
+	}
+	if form.MetadataVersion != "" && !validMetadataVersions[form.MetadataVersion] {
+		return newErrorWithCode(400, "Invalid value for metadata_version. Error: Use a known metadata version.")
+	}
+	for _, digest := range []struct {
+		name   string
+		value  string
+		length int
+	}{
+		{"md5_digest", form.Md5Digest, 32},
+		{"sha256_digest", form.Sha256Digest, 64},
+		{"blake2_256_digest", form.Blake2256Digest, 64},
+	} {
+		if digest.value != "" && (len(digest.value) != digest.length || !hexDigestRegex.MatchString(digest.value)) {
+			return newErrorWithCode(400, "Invalid value for %s. Error: Use a valid, hex-encoded, digest.", digest.name)
+		}
+	}
+	return nil
+}
+
+// Returns the non empty values of a multi-valued form field
+func formValues(r *url.Values, key string) []string {
+	values := []string{}
+	for _, value := range (*r)[key] {
+		if strings.TrimSpace(value) != "" {
+			values = append(values, value)
+		}
+	}
+	return values
 }
 
 var normalizeProjectNameRegex = regexp.MustCompile("[-_.]+")
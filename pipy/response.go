@@ -5,11 +5,20 @@ import (
 	"net/url"
 )
 
+// Version of the simple API served, 1.1 adds size, upload-time and versions (PEP 700)
+var ApiVersion = "1.1"
+
+// Format of upload-time, ISO 8601 with microseconds in UTC
+var UploadTimeFormat = "2006-01-02T15:04:05.000000Z"
+
 // PyPI Simple API Response (PEP 503)
 type Response struct {
+	Meta     Meta     `json:"meta"`
 	Name     string   `json:"name"`
 	Versions []string `json:"versions"`
 	Files    []File   `json:"files"`
+	// Whether the upstreams couldn't be asked for it, so it may be out of date
+	Stale bool `json:"-"`
 }
 
 // File Hashes
@@ -22,10 +31,17 @@ type File struct {
 	Filename       string     `json:"filename"`
 	URL            string     `json:"url"`
 	Hashes         FileHashes `json:"hashes"`
+	Size           *int64     `json:"size,omitempty"`
+	UploadTime     *string    `json:"upload-time,omitempty"`
 	RequiresPython *string    `json:"requires-python,omitempty"`
 	CoreMetadata   *any       `json:"core-metadata,omitempty"`
-	Yanked         *any       `json:"yanked,omitempty"`
-	Provenance     *string    `json:"provenance,omitempty"`
+	// Name of core-metadata before PEP 714, still read by older clients
+	DistInfoMetadata *any    `json:"dist-info-metadata,omitempty"`
+	Yanked           *any    `json:"yanked,omitempty"`
+	Provenance       *string `json:"provenance,omitempty"`
+	// Name of the upstream a file is proxied from, or "local" for uploaded files in merged
+	// descriptors. Keys starting with an underscore are private to the index (PEP 691).
+	Origin string `json:"_origin,omitempty"`
 }
 
 func (f *File) GetUrl() (*url.URL, error) {
@@ -36,6 +52,46 @@ func (f *File) GetUrl() (*url.URL, error) {
 	return parsedUrl, nil
 }
 
+// Returns the PEP 658 core metadata hash as "<hashname>=<hash>", or "" if it has no hash
+func (f *File) CoreMetadataHash() (string, bool) {
+	coreMetadata := f.CoreMetadata
+	if coreMetadata == nil {
+		coreMetadata = f.DistInfoMetadata
+	}
+	if coreMetadata == nil {
+		return "", false
+	}
+	switch value := (*coreMetadata).(type) {
+	case bool:
+		return "", value
+	case map[string]string:
+		if hash, ok := value["sha256"]; ok {
+			return "sha256=" + hash, true
+		}
+		return "", true
+	case map[string]any:
+		if hash, ok := value["sha256"].(string); ok {
+			return "sha256=" + hash, true
+		}
+		return "", true
+	}
+	return "", false
+}
+
+// Returns whether the file is yanked and why, PEP 592 allows either a boolean or a reason
+func (f *File) YankedReason() (string, bool) {
+	if f.Yanked == nil {
+		return "", false
+	}
+	switch yanked := (*f.Yanked).(type) {
+	case bool:
+		return "", yanked
+	case string:
+		return yanked, true
+	}
+	return "", false
+}
+
 // Meta Data
 type Meta struct {
 	ApiVersion          string  `json:"api-version"`
@@ -45,6 +101,7 @@ type Meta struct {
 
 // Index Response
 type IndexResponse struct {
+	Meta     Meta      `json:"meta"`
 	Projects []Project `json:"projects"`
 }
 
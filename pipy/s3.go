@@ -0,0 +1,372 @@
+package pipy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Config configures an S3-compatible object store (AWS S3, MinIO, R2, Ceph...).
+// Objects are addressed path-style: <Endpoint>/<Bucket>/<Prefix>/<key>.
+type S3Config struct {
+	Endpoint        string
+	Region          string
+	Bucket          string
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Client          *http.Client
+}
+
+// S3Storage stores objects in an S3-compatible bucket, so several replicas can share them
+type S3Storage struct {
+	config S3Config
+	client *http.Client
+}
+
+func NewS3Storage(config S3Config) *S3Storage {
+	client := config.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+	config.Prefix = strings.Trim(config.Prefix, "/")
+	return &S3Storage{config: config, client: client}
+}
+
+// Gets the object key below the prefix, rejecting keys that would escape it
+func (s *S3Storage) objectKey(key string) (string, error) {
+	if err := validateKey(key); err != nil {
+		Logger.Warn("Rejected storage key", "key", key)
+		return "", err
+	}
+	if key == "" {
+		return s.config.Prefix, nil
+	}
+	if s.config.Prefix == "" {
+		return key, nil
+	}
+	return s.config.Prefix + "/" + key, nil
+}
+
+func (s *S3Storage) Open(key string) (io.ReadCloser, error) {
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return nil, err
+	}
+	response, err := s.do(http.MethodGet, objectKey, nil, nil, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode == http.StatusNotFound {
+		response.Body.Close()
+		return nil, FileNotFound
+	}
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		return nil, s3Error("get", key, response)
+	}
+	return response.Body, nil
+}
+
+// Spools the content to a temporary file first, S3 needs the length and hash up front
+func (s *S3Storage) Put(key string, r io.Reader) error {
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp("", tempFilePrefix+"s3-*")
+	if err != nil {
+		return newError("failed to create temporary file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return newError("failed to rewind temporary file: %v", err)
+	}
+	response, err := s.do(http.MethodPut, objectKey, nil, &sizedReader{tmp, size}, hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return s3Error("put", key, response)
+	}
+	return nil
+}
+
+func (s *S3Storage) Stat(key string) (*ObjectInfo, error) {
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return nil, err
+	}
+	response, err := s.do(http.MethodHead, objectKey, nil, nil, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return nil, FileNotFound
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, s3Error("head", key, response)
+	}
+	modTime, _ := http.ParseTime(response.Header.Get("Last-Modified"))
+	return &ObjectInfo{
+		Name:    path.Base(key),
+		Size:    response.ContentLength,
+		ModTime: modTime,
+	}, nil
+}
+
+type listBucketResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+func (s *S3Storage) List(prefix string) ([]ObjectInfo, error) {
+	listPrefix, err := s.objectKey(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if listPrefix != "" {
+		listPrefix += "/"
+	}
+	objects := []ObjectInfo{}
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("delimiter", "/")
+		query.Set("prefix", listPrefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		response, err := s.do(http.MethodGet, "", query, nil, emptyPayloadHash)
+		if err != nil {
+			return nil, err
+		}
+		if response.StatusCode != http.StatusOK {
+			defer response.Body.Close()
+			return nil, s3Error("list", prefix, response)
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if err != nil {
+			return nil, newError("failed to decode list response: %v", err)
+		}
+		for _, commonPrefix := range result.CommonPrefixes {
+			objects = append(objects, ObjectInfo{
+				Name:  strings.TrimSuffix(strings.TrimPrefix(commonPrefix.Prefix, listPrefix), "/"),
+				IsDir: true,
+			})
+		}
+		for _, content := range result.Contents {
+			objects = append(objects, ObjectInfo{
+				Name:    strings.TrimPrefix(content.Key, listPrefix),
+				Size:    content.Size,
+				ModTime: content.LastModified,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	if len(objects) == 0 {
+		return nil, FileNotFound
+	}
+	return objects, nil
+}
+
+func (s *S3Storage) Delete(key string) error {
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return err
+	}
+	response, err := s.do(http.MethodDelete, objectKey, nil, nil, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusOK && response.StatusCode != http.StatusNotFound {
+		return s3Error("delete", key, response)
+	}
+	return nil
+}
+
+type sizedReader struct {
+	io.Reader
+	size int64
+}
+
+var emptyPayloadHash = hex.EncodeToString(sha256.New().Sum(nil))
+
+func (s *S3Storage) do(method string, objectKey string, query url.Values, body *sizedReader, payloadHash string) (*http.Response, error) {
+	requestUrl, err := url.Parse(s.config.Endpoint)
+	if err != nil {
+		return nil, newError("invalid S3 endpoint: %v", err)
+	}
+	requestUrl.Path = "/" + s.config.Bucket
+	if objectKey != "" {
+		requestUrl.Path += "/" + objectKey
+	}
+	requestUrl.RawPath = s3EscapePath(requestUrl.Path)
+	requestUrl.RawQuery = s3EncodeQuery(query)
+
+	var reader io.Reader
+	if body != nil {
+		reader = body.Reader
+	}
+	req, err := http.NewRequest(method, requestUrl.String(), reader)
+	if err != nil {
+		return nil, newError("failed to create S3 request: %v", err)
+	}
+	if body != nil {
+		req.ContentLength = body.size
+	}
+	s.sign(req, payloadHash, time.Now().UTC())
+	response, err := s.client.Do(req)
+	if err != nil {
+		return nil, newError("failed to call S3: %v", err)
+	}
+	return response, nil
+}
+
+// Signs the request with AWS Signature Version 4
+func (s *S3Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if s.config.SessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.config.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretAccessKey), date)
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Escapes everything but the unreserved characters, as required by SigV4
+func s3Escape(value string) string {
+	var builder strings.Builder
+	for _, b := range []byte(value) {
+		if ('A' <= b && b <= 'Z') || ('a' <= b && b <= 'z') || ('0' <= b && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' {
+			builder.WriteByte(b)
+		} else {
+			fmt.Fprintf(&builder, "%%%02X", b)
+		}
+	}
+	return builder.String()
+}
+
+func s3EscapePath(value string) string {
+	segments := strings.Split(value, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func s3EncodeQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, s3Escape(key)+"="+s3Escape(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// Logs a failed S3 request with the response body, which names the bucket and the request,
+// and returns a generic Error, as it is passed on to the clients
+func s3Error(operation string, key string, response *http.Response) *Error {
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+	Logger.Error("S3 request failed", "operation", operation, "key", key, "status", response.StatusCode, "body", strings.TrimSpace(string(body)))
+	return &Error{Message: "Storage error.", Code: http.StatusBadGateway}
+}
+
+var _ Storage = &S3Storage{}
@@ -1,8 +1,13 @@
 package pipy
 
 import (
+	"crypto/md5"
 	"crypto/sha256"
 	"encoding/hex"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/blake2b"
 )
 
 func CalculateSHA256(data []byte) string {
@@ -10,3 +15,76 @@ func CalculateSHA256(data []byte) string {
 	hash.Write(data)
 	return hex.EncodeToString(hash.Sum(nil))
 }
+
+// Hex encoded digests of a file
+type FileDigests struct {
+	MD5        string `json:"md5,omitempty"`
+	SHA256     string `json:"sha256,omitempty"`
+	Blake2b256 string `json:"blake2b_256,omitempty"`
+}
+
+// digestReader hashes the content read through it. If expected digests are given, reaching
+// the end of the content with a different digest fails the read instead of returning io.EOF,
+// so the storage discards the content.
+type digestReader struct {
+	reader   io.Reader
+	expected FileDigests
+	md5      hash.Hash
+	sha256   hash.Hash
+	blake2b  hash.Hash
+	size     int64
+}
+
+func newDigestReader(r io.Reader, expected FileDigests) *digestReader {
+	blake2bHash, _ := blake2b.New256(nil)
+	return &digestReader{
+		reader:   r,
+		expected: expected,
+		md5:      md5.New(),
+		sha256:   sha256.New(),
+		blake2b:  blake2bHash,
+	}
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.reader.Read(p)
+	if n > 0 {
+		d.size += int64(n)
+		d.md5.Write(p[:n])
+		d.sha256.Write(p[:n])
+		d.blake2b.Write(p[:n])
+	}
+	if err == io.EOF {
+		if verifyErr := d.verify(); verifyErr != nil {
+			return n, verifyErr
+		}
+	}
+	return n, err
+}
+
+func (d *digestReader) verify() error {
+	digests := d.Digests()
+	for _, digest := range []struct {
+		name     string
+		expected string
+		actual   string
+	}{
+		{"md5_digest", d.expected.MD5, digests.MD5},
+		{"sha256_digest", d.expected.SHA256, digests.SHA256},
+		{"blake2_256_digest", d.expected.Blake2b256, digests.Blake2b256},
+	} {
+		if digest.expected != "" && digest.expected != digest.actual {
+			return newErrorWithCode(400, "The %s supplied does not match a digest calculated from the uploaded file.", digest.name)
+		}
+	}
+	return nil
+}
+
+// Digests of the content read so far
+func (d *digestReader) Digests() FileDigests {
+	return FileDigests{
+		MD5:        hex.EncodeToString(d.md5.Sum(nil)),
+		SHA256:     hex.EncodeToString(d.sha256.Sum(nil)),
+		Blake2b256: hex.EncodeToString(d.blake2b.Sum(nil)),
+	}
+}
@@ -0,0 +1,214 @@
+package pipy
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Storage is the blob store holding uploaded and cached package files.
+// Keys are slash separated paths relative to the storage root, for example
+// "numpy/2.3.4/numpy-2.3.4.tar.gz".
+type Storage interface {
+	// Open returns the content stored at key, or FileNotFound.
+	Open(key string) (io.ReadCloser, error)
+	// Put stores the content of r at key. If reading r fails nothing is stored.
+	Put(key string, r io.Reader) error
+	// Stat returns information about the object stored at key, or FileNotFound.
+	Stat(key string) (*ObjectInfo, error)
+	// List returns the direct children of prefix, both objects and "directories".
+	List(prefix string) ([]ObjectInfo, error)
+	// Delete removes the object stored at key. Missing objects are not an error.
+	Delete(key string) error
+}
+
+type ObjectInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+var storage Storage
+
+// Sets the storage used by the package functions, defaulting to the local file system
+func SetupStorage(s Storage) {
+	if s == nil {
+		s = NewFileSystemStorage(storagePath)
+	}
+	storage = s
+}
+
+// Serves the objects in the storage, using the request path as the key. Range and
+// conditional requests are supported when the storage object can seek.
+func FileServer() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/")
+		file, err := storage.Open(key)
+		if err != nil {
+			if err == FileNotFound {
+				http.NotFound(w, r)
+				return
+			}
+			Logger.Error("Failed to open file", "key", key, "error", err)
+			http.Error(w, "Failed to open file", http.StatusInternalServerError)
+			return
+		}
+		defer file.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		var modTime time.Time
+		info, err := storage.Stat(key)
+		if err == nil {
+			modTime = info.ModTime
+		}
+		if seeker, ok := file.(io.ReadSeeker); ok {
+			http.ServeContent(w, r, path.Base(key), modTime, seeker)
+			return
+		}
+		if info != nil {
+			w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+			if !modTime.IsZero() {
+				w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+			}
+		}
+		if _, err := io.Copy(w, file); err != nil {
+			Logger.Error("Failed to copy file", "key", key, "error", err)
+		}
+	})
+}
+
+// FileSystemStorage stores objects as files below a root directory
+type FileSystemStorage struct {
+	root string
+}
+
+func NewFileSystemStorage(root string) *FileSystemStorage {
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		os.MkdirAll(root, 0755)
+	}
+	return &FileSystemStorage{root: root}
+}
+
+func (s *FileSystemStorage) path(key string) (string, error) {
+	return resolveKey(s.root, key)
+}
+
+func (s *FileSystemStorage) Open(key string) (io.ReadCloser, error) {
+	filePath, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, FileNotFound
+		}
+		return nil, newError("failed to open file: %v", err)
+	}
+	return file, nil
+}
+
+// Writes to a temporary file next to the destination and renames it once complete
+func (s *FileSystemStorage) Put(key string, r io.Reader) error {
+	filePath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(filePath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return newError("failed to create directory: %v", err)
+	}
+	tmp, err := os.CreateTemp(dir, tempFilePrefix+"*")
+	if err != nil {
+		return newError("failed to create file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	// Flushed before the rename, so a crash can't leave a partial file under the key
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return newError("failed to sync file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return newError("failed to close file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		return newError("failed to rename file: %v", err)
+	}
+	return nil
+}
+
+func (s *FileSystemStorage) Stat(key string) (*ObjectInfo, error) {
+	filePath, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, FileNotFound
+		}
+		return nil, newError("failed to stat file: %v", err)
+	}
+	return &ObjectInfo{
+		Name:    info.Name(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		IsDir:   info.IsDir(),
+	}, nil
+}
+
+func (s *FileSystemStorage) List(prefix string) ([]ObjectInfo, error) {
+	dirPath, err := s.path(prefix)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, FileNotFound
+		}
+		return nil, newError("failed to read directory: %v", err)
+	}
+	objects := []ObjectInfo{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), tempFilePrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		objects = append(objects, ObjectInfo{
+			Name:    entry.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			IsDir:   entry.IsDir(),
+		})
+	}
+	return objects, nil
+}
+
+func (s *FileSystemStorage) Delete(key string) error {
+	filePath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return newError("failed to delete file: %v", err)
+	}
+	return nil
+}
+
+var tempFilePrefix = ".tmp-"
+
+var _ Storage = &FileSystemStorage{}
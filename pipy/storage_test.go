@@ -0,0 +1,332 @@
+package pipy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeS3 is a minimal in-process S3 server supporting path-style object and list requests
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{bucket: bucket, objects: map[string][]byte{}}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test-key/") {
+		http.Error(w, "missing signature", http.StatusForbidden)
+		return
+	}
+	bucketPath := "/" + f.bucket
+	if r.URL.Path != bucketPath && !strings.HasPrefix(r.URL.Path, bucketPath+"/") {
+		http.Error(w, "no such bucket", http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, bucketPath), "/")
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, r)
+	case r.Method == http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		sum := sha256.Sum256(body)
+		if r.Header.Get("x-amz-content-sha256") != hex.EncodeToString(sum[:]) {
+			http.Error(w, "bad content hash", http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = body
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		body, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "no such key", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		http.ServeContent(w, r, key, time.Time{}, bytes.NewReader(body))
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	delimiter := r.URL.Query().Get("delimiter")
+	var result listBucketResult
+	seen := map[string]bool{}
+	keys := []string{}
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(key, prefix)
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			commonPrefix := prefix + rest[:i+1]
+			if !seen[commonPrefix] {
+				seen[commonPrefix] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, struct {
+					Prefix string `xml:"Prefix"`
+				}{commonPrefix})
+			}
+			continue
+		}
+		result.Contents = append(result.Contents, struct {
+			Key          string    `xml:"Key"`
+			Size         int64     `xml:"Size"`
+			LastModified time.Time `xml:"LastModified"`
+		}{key, int64(len(f.objects[key])), time.Now().UTC()})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func newTestS3Storage(t *testing.T) *S3Storage {
+	server := httptest.NewServer(newFakeS3("packages"))
+	t.Cleanup(server.Close)
+	return NewS3Storage(S3Config{
+		Endpoint:        server.URL,
+		Bucket:          "packages",
+		Prefix:          "pypi",
+		AccessKeyID:     "test-key",
+		SecretAccessKey: "test-secret",
+	})
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestStorage(t *testing.T) {
+	backends := map[string]func(t *testing.T) Storage{
+		"filesystem": func(t *testing.T) Storage { return NewFileSystemStorage(t.TempDir()) },
+		"s3":         func(t *testing.T) Storage { return newTestS3Storage(t) },
+	}
+	for name, newStorage := range backends {
+		t.Run(name, func(t *testing.T) {
+			s := newStorage(t)
+
+			_, err := s.Open("numpy/1.0/numpy-1.0.tar.gz")
+			assert.Equal(t, FileNotFound, err)
+			_, err = s.List("numpy")
+			assert.Equal(t, FileNotFound, err)
+
+			assert.NoError(t, s.Put("numpy/1.0/numpy-1.0.tar.gz", strings.NewReader("sdist")))
+			assert.NoError(t, s.Put("numpy/1.0/numpy-1.0-py3-none-any.whl", strings.NewReader("wheel")))
+			assert.NoError(t, s.Put("numpy/2.0/numpy-2.0.tar.gz", strings.NewReader("sdist 2")))
+
+			file, err := s.Open("numpy/1.0/numpy-1.0.tar.gz")
+			assert.NoError(t, err)
+			content, _ := io.ReadAll(file)
+			file.Close()
+			assert.Equal(t, "sdist", string(content))
+
+			info, err := s.Stat("numpy/1.0/numpy-1.0-py3-none-any.whl")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(5), info.Size)
+
+			projects, err := s.List("")
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"numpy"}, objectNames(projects))
+			assert.True(t, projects[0].IsDir)
+
+			versions, err := s.List("numpy")
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, []string{"1.0", "2.0"}, objectNames(versions))
+
+			files, err := s.List("numpy/1.0")
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, []string{"numpy-1.0.tar.gz", "numpy-1.0-py3-none-any.whl"}, objectNames(files))
+
+			err = s.Put("numpy/1.0/numpy-1.0.zip", io.MultiReader(strings.NewReader("partial"), failingReader{}))
+			assert.Error(t, err)
+			_, err = s.Stat("numpy/1.0/numpy-1.0.zip")
+			assert.Equal(t, FileNotFound, err)
+
+			assert.NoError(t, s.Delete("numpy/2.0/numpy-2.0.tar.gz"))
+			assert.NoError(t, s.Delete("numpy/2.0/numpy-2.0.tar.gz"))
+			_, err = s.Open("numpy/2.0/numpy-2.0.tar.gz")
+			assert.Equal(t, FileNotFound, err)
+		})
+	}
+}
+
+func objectNames(objects []ObjectInfo) []string {
+	names := []string{}
+	for _, object := range objects {
+		names = append(names, object.Name)
+	}
+	return names
+}
+
+func TestS3ErrorsHideTheResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("<Error><Code>AccessDenied</Code><BucketName>packages</BucketName><RequestId>4442587FB7D0A2F9</RequestId></Error>"))
+	}))
+	defer server.Close()
+	s := NewS3Storage(S3Config{Endpoint: server.URL, Bucket: "packages", AccessKeyID: "test-key", SecretAccessKey: "test-secret"})
+
+	_, err := s.Open("my-package/1.0/my_package-1.0.tar.gz")
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusBadGateway, err.(*Error).Code)
+		assert.NotContains(t, err.Error(), "packages")
+		assert.NotContains(t, err.Error(), "4442587FB7D0A2F9")
+	}
+}
+
+func TestPackageFunctionsWithS3Storage(t *testing.T) {
+	useTestStorage(t)
+	SetupStorage(newTestS3Storage(t))
+
+	assert.NoError(t, storage.Put("my-package/1.0/my_package-1.0.tar.gz", strings.NewReader("sdist")))
+	assert.NoError(t, Reindex())
+
+	index, err := GetIndexResponse()
+	assert.NoError(t, err)
+	assert.Equal(t, []Project{{Name: "my-package"}}, index.Projects)
+
+	descriptor, err := GetPackageDescriptor("My_Package")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1.0"}, descriptor.Versions)
+	assert.Len(t, descriptor.Files, 1)
+	assert.Equal(t, CalculateSHA256([]byte("sdist")), descriptor.Files[0].Hashes.SHA256)
+
+	_, err = GetPackageDescriptor("other")
+	assert.Equal(t, RepoNotFound, err)
+}
+
+func TestFileServer(t *testing.T) {
+	useTestStorage(t)
+	for name, s := range map[string]Storage{"fs": storage, "s3": newTestS3Storage(t)} {
+		t.Run(name, func(t *testing.T) {
+			SetupStorage(s)
+			assert.NoError(t, storage.Put("my-package/1.0/my_package-1.0.tar.gz", strings.NewReader("sdist")))
+			server := httptest.NewServer(FileServer())
+			defer server.Close()
+
+			resp, err := http.Get(server.URL + "/my-package/1.0/my_package-1.0.tar.gz")
+			assert.NoError(t, err)
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "sdist", string(body))
+			assert.Equal(t, int64(5), resp.ContentLength)
+			assert.Equal(t, "application/octet-stream", resp.Header.Get("Content-Type"))
+			if name != "fs" {
+				return
+			}
+
+			// Resumed downloads
+			req, err := http.NewRequest("GET", server.URL+"/my-package/1.0/my_package-1.0.tar.gz", nil)
+			assert.NoError(t, err)
+			req.Header.Set("Range", "bytes=2-")
+			resp, err = http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			body, _ = io.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+			assert.Equal(t, "ist", string(body))
+		})
+	}
+}
+
+func TestProjectsUploadedThroughAnotherReplica(t *testing.T) {
+	useTestStorage(t)
+	SetupStorage(newTestS3Storage(t))
+	_, err := storeFile("my-package", "1.0", "my_package-1.0.tar.gz", strings.NewReader("sdist"), FileDigests{})
+	assert.NoError(t, err)
+
+	// Another replica, with its own index
+	other, err := OpenIndex(filepath.Join(t.TempDir(), "index.db"))
+	assert.NoError(t, err)
+	defer other.Close()
+	previousIndex := index
+	index = other
+	defer func() { index = previousIndex }()
+
+	descriptor, err := GetPackageDescriptor("my-package")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1.0"}, descriptor.Versions)
+	assert.Equal(t, CalculateSHA256([]byte("sdist")), descriptor.Files[0].Hashes.SHA256)
+	projects, err := other.Projects()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"my-package"}, projects)
+
+	_, err = GetPackageDescriptor("other")
+	assert.Equal(t, RepoNotFound, err)
+}
+
+func TestIsolationOfProjectsUploadedThroughAnotherReplica(t *testing.T) {
+	stored := useTestStorage(t)
+	defer SetupProxyProtection(nil, false)
+	assert.NoError(t, SetupProxyProtection(nil, true))
+
+	// Uploaded through another replica, this one has an empty index
+	assert.NoError(t, stored.Put("my-package/1.0/my_package-1.0.tar.gz", strings.NewReader("sdist")))
+	err := checkProxyAllowed("my-package", "my_package-2.0.tar.gz")
+	if assert.Error(t, err) {
+		assert.Equal(t, 403, err.(*Error).Code)
+	}
+	assert.NoError(t, checkProxyAllowed("numpy", "numpy-2.3.4.tar.gz"))
+}
+
+// Storage counting its listings
+type countingStorage struct {
+	Storage
+	lists *int
+}
+
+func (s countingStorage) List(prefix string) ([]ObjectInfo, error) {
+	*s.lists++
+	return s.Storage.List(prefix)
+}
+
+func TestProjectsMissingFromTheStorageAreRemembered(t *testing.T) {
+	stored := useTestStorage(t)
+	lists := 0
+	SetupStorage(countingStorage{Storage: stored, lists: &lists})
+
+	for range 3 {
+		_, err := GetPackageDescriptor("numpy")
+		assert.Equal(t, RepoNotFound, err)
+	}
+	assert.Equal(t, 1, lists)
+
+	// Found once the miss expires, e.g. when uploaded through another replica
+	assert.NoError(t, stored.Put("numpy/2.3.4/numpy-2.3.4.tar.gz", strings.NewReader("sdist")))
+	_, err := GetPackageDescriptor("numpy")
+	assert.Equal(t, RepoNotFound, err)
+	previousTTL := storageMissTTL
+	storageMissTTL = 0
+	defer func() { storageMissTTL = previousTTL }()
+	descriptor, err := GetPackageDescriptor("numpy")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2.3.4"}, descriptor.Versions)
+}
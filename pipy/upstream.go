@@ -0,0 +1,212 @@
+package pipy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var defaultUpstreamUrl = "https://pypi.org/simple"
+var defaultUpstreamTimeout = 30 * time.Second
+
+// UpstreamConfig configures the index proxied for projects that aren't hosted locally, e.g.
+// pypi.org, an Artifactory or devpi mirror, or another go-pypi
+type UpstreamConfig struct {
+	// Recorded on the files proxied from it, defaults to the host of URL
+	Name string
+	// Simple index URL, defaults to https://pypi.org/simple
+	URL string
+	// Project names or globs (e.g. "acme-*") only taken from this upstream, normalized like
+	// project names. Upstreams without projects serve the projects no routing rule names.
+	Projects []string
+	// Bounds connecting and waiting for the response headers, defaults to 30s.
+	// Downloads of large files aren't cut off.
+	Timeout time.Duration
+	// PEM bundle of certificate authorities trusted in addition to the system ones
+	CAFile string
+	// Client certificate and key for upstreams requiring mutual TLS
+	CertFile string
+	KeyFile  string
+	// Disables certificate verification, only meant for testing
+	InsecureSkipVerify bool
+	// Used as is when set, ignoring the settings above
+	Client *http.Client
+}
+
+// Upstream is a remote simple index
+type Upstream struct {
+	Name     string
+	URL      string
+	projects []string
+	client   *http.Client
+}
+
+// Upstreams in priority order
+var upstreams []*Upstream
+
+// Whether the upstreams are never asked, only the cache is served
+var offline bool
+
+// Returned instead of asking an upstream in offline mode
+var UpstreamOffline = &Error{Message: "upstreams aren't available in offline mode", Code: 503}
+
+// Sets whether only the cached descriptors and files are served, without asking the upstreams
+func SetupOfflineMode(enabled bool) {
+	offline = enabled
+}
+
+// Sets the upstreams used by the proxy, in priority order. Defaults to pypi.org.
+func SetupUpstreams(configs []UpstreamConfig) error {
+	if len(configs) == 0 {
+		configs = []UpstreamConfig{{}}
+	}
+	configured := []*Upstream{}
+	names := map[string]bool{}
+	for _, config := range configs {
+		u, err := NewUpstream(config)
+		if err != nil {
+			return err
+		}
+		if names[u.Name] {
+			return newError("upstream %q is configured twice, give them different names", u.Name)
+		}
+		names[u.Name] = true
+		configured = append(configured, u)
+	}
+	upstreams = configured
+	return nil
+}
+
+func NewUpstream(config UpstreamConfig) (*Upstream, error) {
+	if config.URL == "" {
+		config.URL = defaultUpstreamUrl
+	}
+	config.URL = strings.TrimSuffix(config.URL, "/")
+	parsedUrl, err := url.Parse(config.URL)
+	if err != nil || parsedUrl.Host == "" {
+		return nil, newError("invalid upstream URL %q", config.URL)
+	}
+	if config.Name == "" {
+		config.Name = parsedUrl.Host
+	}
+	projects, err := normalizeProjectPatterns(config.Projects, "project pattern of upstream "+config.Name)
+	if err != nil {
+		return nil, err
+	}
+	u := &Upstream{Name: config.Name, URL: config.URL, projects: projects, client: config.Client}
+	if u.client != nil {
+		return u, nil
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultUpstreamTimeout
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, newError("failed to read upstream CA bundle: %v", err)
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, newError("upstream CA bundle %s has no PEM certificates", config.CAFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, newError("failed to load upstream client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: config.Timeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = config.Timeout
+	transport.ResponseHeaderTimeout = config.Timeout
+	transport.TLSClientConfig = tlsConfig
+	u.client = &http.Client{Transport: transport}
+	return u, nil
+}
+
+// Reports whether one of the routing rules of the upstream names the project
+func (u *Upstream) routes(project string) bool {
+	return matchProject(u.projects, project)
+}
+
+// Gets the upstreams serving a project, in priority order. Projects named by routing rules
+// only come from the upstreams naming them, others from the upstreams without rules.
+func upstreamsFor(project string) []*Upstream {
+	routed, catchAll := []*Upstream{}, []*Upstream{}
+	for _, u := range upstreams {
+		if len(u.projects) == 0 {
+			catchAll = append(catchAll, u)
+		} else if u.routes(project) {
+			routed = append(routed, u)
+		}
+	}
+	if len(routed) > 0 {
+		return routed
+	}
+	return catchAll
+}
+
+// Gets a URL with the upstream client, so files and metadata use the same TLS settings
+func (u *Upstream) get(url string, accept string, header http.Header) (*http.Response, error) {
+	if offline {
+		return nil, UpstreamOffline
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	return u.client.Do(req)
+}
+
+// Describes a failed request for a resource of the upstream: timeouts are 504 and other
+// failures 502
+func (u *Upstream) requestError(what string, err error) error {
+	if err == UpstreamOffline {
+		return err
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return &Error{Message: fmt.Sprintf("upstream %s timed out getting %s", u.Name, what), Code: http.StatusGatewayTimeout}
+	}
+	return &Error{Message: fmt.Sprintf("failed to get %s from upstream %s: %v", what, u.Name, err), Code: http.StatusBadGateway}
+}
+
+// Describes an upstream response that isn't a 200, so its body is never taken for the
+// resource: a 404 is not found, a 504 is passed on and other responses are 502
+func (u *Upstream) responseError(what string, response *http.Response) error {
+	code := http.StatusBadGateway
+	switch response.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound, http.StatusGatewayTimeout:
+		code = response.StatusCode
+	}
+	return &Error{Message: fmt.Sprintf("upstream %s answered %s getting %s", u.Name, response.Status, what), Code: code}
+}
+
+// URL of the simple page of a project
+func (u *Upstream) projectUrl(project string) string {
+	return fmt.Sprintf("%s/%s/", u.URL, project)
+}
@@ -0,0 +1,63 @@
+package pipy
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamTrustsCAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	untrusted, err := NewUpstream(UpstreamConfig{URL: server.URL})
+	assert.NoError(t, err)
+	_, err = untrusted.get(server.URL, "", nil)
+	assert.Error(t, err)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	assert.NoError(t, os.WriteFile(caFile, certificate, 0644))
+	trusted, err := NewUpstream(UpstreamConfig{URL: server.URL, CAFile: caFile})
+	assert.NoError(t, err)
+	response, err := trusted.get(server.URL, "", nil)
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	assert.NoError(t, os.WriteFile(caFile, []byte("not a certificate"), 0644))
+	_, err = NewUpstream(UpstreamConfig{URL: server.URL, CAFile: caFile})
+	assert.Error(t, err)
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	u, err := NewUpstream(UpstreamConfig{URL: server.URL + "/simple/", Timeout: 50 * time.Millisecond})
+	assert.NoError(t, err)
+	assert.Equal(t, server.URL+"/simple", u.URL)
+	assert.Equal(t, server.URL+"/simple/numpy/", u.projectUrl("numpy"))
+	_, err = u.get(u.projectUrl("numpy"), "", nil)
+	assert.Error(t, err)
+}
+
+func TestUpstreamRoutesNormalizedProjects(t *testing.T) {
+	u, err := NewUpstream(UpstreamConfig{URL: "https://pypi.internal.example/simple", Projects: []string{"ACME_*", "Internal.Tools"}})
+	assert.NoError(t, err)
+	assert.True(t, u.routes("acme-widgets"))
+	assert.True(t, u.routes("internal_tools"))
+	assert.False(t, u.routes("numpy"))
+}
@@ -4,8 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"path"
 	"path/filepath"
-	"regexp"
 	"strings"
 )
 
@@ -15,20 +15,20 @@ type ProjectInfo struct {
 	Filename string
 }
 
-var repoRegex = regexp.MustCompile(`([\w_\-]+)-(.*?)(?:\.tar\.gz|\.exe|\.zip|\.whl|\.egg|\.rpm)$`)
-
+// Gets the project and version of a distribution filename or URL, failing for names that
+// aren't valid distribution filenames
 func ParseProjectData(fileName string) (ProjectInfo, error) {
 	if strings.HasPrefix(fileName, "http") {
 		fileName = filepath.Base(fileName)
 	}
 
-	match := repoRegex.FindStringSubmatch(fileName)
-	if len(match) == 0 {
-		return ProjectInfo{}, fmt.Errorf("failed to parse repo data: %v", fileName)
+	distribution, err := ParseDistributionFilename(fileName)
+	if err != nil {
+		return ProjectInfo{}, err
 	}
 	return ProjectInfo{
-		Repo:     match[1],
-		Version:  match[2],
+		Repo:     distribution.Name,
+		Version:  distribution.Version,
 		Filename: fileName,
 	}, nil
 }
@@ -81,3 +81,27 @@ func TryPrettyPrintJson(body []byte) string {
 	}
 	return string(jsonString)
 }
+
+// Reports whether the normalized project name matches one of the names or globs
+func matchProject(patterns []string, project string) bool {
+	project = NormalizeProjectName(project)
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, project); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks project names or globs given in the configuration, what describes them in errors,
+// and normalizes them like the project names they are matched against
+func normalizeProjectPatterns(patterns []string, what string) ([]string, error) {
+	normalized := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, newError("invalid %s %q: %v", what, pattern, err)
+		}
+		normalized = append(normalized, NormalizeProjectName(pattern))
+	}
+	return normalized, nil
+}
@@ -36,11 +36,11 @@ func TestParseRepoData(t *testing.T) {
 			},
 		},
 		{
-			fileName: "numpy-1.26.0.whl",
+			fileName: "numpy-1.26.0-py3-none-any.whl",
 			want: ProjectInfo{
 				Repo:     "numpy",
 				Version:  "1.26.0",
-				Filename: "numpy-1.26.0.whl",
+				Filename: "numpy-1.26.0-py3-none-any.whl",
 			},
 		},
 	}
@@ -104,3 +104,77 @@ func TestEncodeUrlAsUrlSafeBase64(t *testing.T) {
 }
 
 //
+
+func TestParseRepoDataWheelTags(t *testing.T) {
+	tests := map[string]ProjectInfo{
+		"numpy-2.3.4-cp312-cp312-manylinux_2_17_x86_64.manylinux2014_x86_64.whl": {Repo: "numpy", Version: "2.3.4"},
+		"requests-2.32.3-py3-none-any.whl":                                       {Repo: "requests", Version: "2.32.3"},
+		"my_package-1.0-1-py2.py3-none-any.whl":                                  {Repo: "my_package", Version: "1.0"},
+		"python-dateutil-2.9.0.post0.tar.gz":                                     {Repo: "python-dateutil", Version: "2.9.0.post0"},
+	}
+	for fileName, want := range tests {
+		t.Run(fileName, func(t *testing.T) {
+			want.Filename = fileName
+			got, err := ParseProjectData("https://files.example.com/packages/ab/cd/" + fileName)
+			if err != nil {
+				t.Errorf("parseRepoData(%s) = %v", fileName, err)
+			}
+			if got != want {
+				t.Errorf("parseRepoData(%s) = %v, want %v", fileName, got, want)
+			}
+		})
+	}
+}
+
+func TestParseRepoDataRejectsInvalidFilenames(t *testing.T) {
+	for _, fileName := range []string{
+		"numpy-1.26.0.whl",
+		"numpy-2.3.4-cp312-cp312-manylinux_2_17_x86_64-extra.whl",
+		"numpy.tar.gz",
+		"numpy-1.26.0.txt",
+	} {
+		t.Run(fileName, func(t *testing.T) {
+			if got, err := ParseProjectData("https://files.example.com/packages/ab/cd/" + fileName); err == nil {
+				t.Errorf("parseRepoData(%s) = %v, want an error", fileName, got)
+			}
+		})
+	}
+}
+
+func TestMatchProjectNormalizesPatterns(t *testing.T) {
+	patterns, err := normalizeProjectPatterns([]string{"Acme_Internal", "ACME.*", "internal-tools"}, "pattern")
+	if err != nil {
+		t.Fatalf("normalizeProjectPatterns() = %v", err)
+	}
+	for project, want := range map[string]bool{
+		"acme-internal":  true,
+		"Acme.Internal":  true,
+		"acme-widgets":   true,
+		"ACME_Widgets":   true,
+		"Internal_Tools": true,
+		"acme":           false,
+		"numpy":          false,
+	} {
+		if got := matchProject(patterns, project); got != want {
+			t.Errorf("matchProject(%v, %s) = %v, want %v", patterns, project, got, want)
+		}
+	}
+	if _, err := normalizeProjectPatterns([]string{"acme-["}, "pattern"); err == nil {
+		t.Errorf("normalizeProjectPatterns(acme-[) succeeded, want an error")
+	}
+
+	defer SetupProxyProtection(nil, false)
+	if err := SetupProxyProtection([]string{"Acme_Internal", "ACME-*"}, false); err != nil {
+		t.Fatalf("SetupProxyProtection() = %v", err)
+	}
+	if !isReserved("acme-internal") || !isReserved("acme-widgets") {
+		t.Errorf("isReserved() = false for projects matching %v", reservedProjects)
+	}
+	defer SetupMergedProjects(nil)
+	if err := SetupMergedProjects([]string{"Shared_Lib"}); err != nil {
+		t.Fatalf("SetupMergedProjects() = %v", err)
+	}
+	if !matchProject(mergedProjects, "shared-lib") {
+		t.Errorf("matchProject(%v, shared-lib) = false, want true", mergedProjects)
+	}
+}
@@ -0,0 +1,40 @@
+package pipy
+
+// Yanks (PEP 592) the files of a release, or only filename when it isn't empty.
+// Un-yanks them when yanked is false.
+func SetYanked(project string, version string, filename string, yanked bool, reason string) error {
+	releases, err := index.Releases(project)
+	if err != nil {
+		return err
+	}
+	version = releaseVersion(project, version)
+	for _, release := range releases {
+		if release.Version != version {
+			continue
+		}
+		found := false
+		for _, record := range release.Files {
+			if filename != "" && record.Filename != filename {
+				continue
+			}
+			found = true
+			record.Yanked = yanked
+			record.YankedReason = ""
+			if yanked {
+				record.YankedReason = reason
+			}
+			if err := saveFileRecord(packageVersionKey(project, version), &record); err != nil {
+				return err
+			}
+			if err := index.PutFile(project, version, &record); err != nil {
+				return err
+			}
+			Logger.Info("Updated yanked state", "project", project, "version", version, "file", record.Filename, "yanked", yanked, "reason", reason)
+		}
+		if !found {
+			return FileNotFound
+		}
+		return nil
+	}
+	return RepoNotFound
+}